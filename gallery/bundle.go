@@ -0,0 +1,90 @@
+package gallery
+
+import (
+	"archive/zip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// bundleLayout returns copy of a with HTML, ThumbsDir and FullsizeDir moved
+// into dir, keeping their layout relative to html file directory, which
+// becomes the root of the bundle
+func (a Options) bundleLayout(dir string) (Options, error) {
+	root := filepath.Dir(a.HTML)
+	for _, p := range []*string{&a.ThumbsDir, &a.FullsizeDir} {
+		rel, err := filepath.Rel(root, *p)
+		if err != nil {
+			return a, err
+		}
+		*p = filepath.Join(dir, rel)
+	}
+	a.HTML = filepath.Join(dir, filepath.Base(a.HTML))
+	return a, nil
+}
+
+// insideDir reports whether p is dir or is located inside it
+func insideDir(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// writeBundle writes all files found in dir into zip archive name, with paths
+// relative to dir. Jpeg files are stored uncompressed, as deflate does not
+// make them any smaller.
+func writeBundle(name, dir string) error {
+	tf, err := ioutil.TempFile(filepath.Dir(name), "photo-gallery-bundle-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer tf.Close()
+	var defuse bool
+	defer func() {
+		if !defuse {
+			_ = os.Remove(tf.Name())
+		}
+	}()
+	zw := zip.NewWriter(tf)
+	walkFunc := func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		hdr, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		hdr.Method = zip.Deflate
+		if strings.EqualFold(filepath.Ext(p), ".jpg") {
+			hdr.Method = zip.Store
+		}
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(w, f)
+		return err
+	}
+	if err := filepath.Walk(dir, walkFunc); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := tf.Close(); err != nil {
+		return err
+	}
+	defuse = true
+	return os.Rename(tf.Name(), name)
+}
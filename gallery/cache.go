@@ -0,0 +1,724 @@
+package gallery
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/artyom/phash"
+)
+
+type galleryCache struct {
+	Name     string
+	Footer   string `json:",omitempty"` // plain text, rendered instead of default footer
+	URL      string `json:",omitempty"` // public url of html file
+	TimeFrom string `json:",omitempty"` // image time source, one of TimeSources
+	HashFunc string `json:",omitempty"` // hash function name, one of HashFuncs
+	UsePhash bool   // whether HashFunc is HashPhash, kept for compatibility
+
+	// Description is plain text shown in link previews instead of Summary
+	Description string `json:",omitempty"`
+
+	// TemplateHash is hex-encoded SHA-256 of templates html was rendered
+	// with, it is used to report template changes between runs
+	TemplateHash string `json:",omitempty"`
+
+	// RelativeSources is set if Image.Source values are relative to source
+	// directory, older caches stored paths as they were found by walk
+	RelativeSources bool `json:",omitempty"`
+
+	hasher Hasher // implementation of HashFunc
+
+	CustomCSS      template.CSS `json:"-"` // inlined after default styles
+	StylesheetHref string       `json:"-"` // linked after default styles
+	BaseURL        string       `json:"-"` // url of html file directory images are loaded from, see ImageURL
+	Permalinks     bool         `json:"-"` // whether per-image pages are generated
+	Schema         bool         `json:"-"` // whether to embed schema.org metadata, see SchemaJSON
+	Eager          int          `json:"-"` // number of first thumbnails preloaded and loaded with high priority
+	GridMinWidth   int          `json:"-"` // minimum width of grid columns in pixels
+	Layout         string       `json:"-"` // thumbnails layout, one of Layouts
+	Spans          bool         `json:"-"` // whether panoramas span two grid columns
+	FeaturedApart  bool         `json:"-"` // whether featured images are left out of the grid
+	MarkNew        bool         `json:"-"` // whether images with New set get a badge
+	Minify         bool         `json:"-"` // whether html output is minified
+	NoIndex        bool         `json:"-"` // whether search engines are asked not to index pages
+	Favicon        template.URL `json:"-"` // data url of custom icon, default one is used if empty
+	DedupeBrackets bool         `json:"-"` // whether bracketed frames are allowed in, see dropBrackets
+	KeepSimilar    bool         `json:"-"` // whether similar images are added instead of reported as duplicates
+	Stacks         bool         `json:"-"` // whether bursts are shown as stacks, see setStacks
+	Initial        int          `json:"-"` // number of images rendered before the rest is loaded, see Deferred
+
+	// PasswordSalt and PasswordHash are set for galleries protected with
+	// client-side password check, hash is hex-encoded SHA-256 of salt
+	// followed by password
+	PasswordSalt string `json:"-"`
+	PasswordHash string `json:"-"`
+
+	// Grid holds images shown in the grid, Lightboxes holds ones shown
+	// full size: featured images left out of the grid, followed by Grid;
+	// both are set by setGrid
+	Grid       []Image `json:"-"`
+	Lightboxes []Image `json:"-"`
+
+	// Earliest and Latest are times of the oldest and newest images, set by
+	// setTimeRange
+	Earliest time.Time `json:"-"`
+	Latest   time.Time `json:"-"`
+
+	// Tags is a sorted set of all image tags, set by setTags
+	Tags []string `json:"-"`
+
+	// onceSortPhash guards initial sort of Images by increasing Hash when run
+	// with perceptual hasher, so add method can rely on binary search
+	onceSortPhash sync.Once
+
+	mu     sync.Mutex
+	Images []Image
+
+	// dups is used to track duplicates when hasher is not perceptual, and
+	// Image.Hash and Image.Digest hold file-based hash
+	dups map[string]string // key is Image.key(), value is Image.Source
+	n    int               // number of images added to the gallery during program run
+}
+
+// sortByTime sorts gallery dy time in descending order (newest images first);
+// images taken at the same time are ordered by source name
+func (c *galleryCache) sortByTime() {
+	sort.Slice(c.Images, func(i, j int) bool {
+		if t1, t2 := c.Images[i].Time, c.Images[j].Time; !t1.Equal(t2) {
+			return t1.After(t2)
+		}
+		return c.Images[i].Source < c.Images[j].Source
+	})
+}
+
+// setTimeRange sets Earliest and Latest fields; it expects Images to be
+// already sorted by sortByTime
+func (c *galleryCache) setTimeRange() {
+	if len(c.Images) == 0 {
+		return
+	}
+	c.Latest = c.Images[0].Time
+	c.Earliest = c.Images[len(c.Images)-1].Time
+}
+
+// setTags sets Tags field to a sorted set of all image tags
+func (c *galleryCache) setTags() {
+	seen := make(map[string]struct{})
+	c.Tags = c.Tags[:0]
+	for _, img := range c.Images {
+		for _, t := range img.Tags {
+			if _, ok := seen[t]; ok {
+				continue
+			}
+			seen[t] = struct{}{}
+			c.Tags = append(c.Tags, t)
+		}
+	}
+	sort.Strings(c.Tags)
+}
+
+// DateRange returns human-readable range of dates images were taken, like
+// "May–August 2024". It returns an empty string if time range is not set.
+func (c *galleryCache) DateRange() string {
+	t1, t2 := c.Earliest, c.Latest
+	switch {
+	case t1.IsZero() || t2.IsZero():
+		return ""
+	case t1.Year() != t2.Year():
+		return t1.Format("January 2006") + "–" + t2.Format("January 2006")
+	case t1.Month() != t2.Month():
+		return t1.Format("January") + "–" + t2.Format("January 2006")
+	case t1.Day() != t2.Day():
+		return t1.Format("January 2006")
+	}
+	return t1.Format("2 January 2006")
+}
+
+// FeaturedImages returns images shown in the featured section
+func (c *galleryCache) FeaturedImages() []Image {
+	var out []Image
+	for _, img := range c.Images {
+		if img.Featured {
+			out = append(out, img)
+		}
+	}
+	return out
+}
+
+// Summary returns short gallery description like "142 photos, May–August 2024"
+func (c *galleryCache) Summary() string {
+	s := fmt.Sprintf("%d photos", len(c.Images))
+	if len(c.Images) == 1 {
+		s = "1 photo"
+	}
+	if r := c.DateRange(); r != "" {
+		s += ", " + r
+	}
+	return s
+}
+
+// AbsURL returns p resolved relative to gallery URL. It returns an empty
+// string if gallery URL is not set.
+func (c *galleryCache) AbsURL(p string) string {
+	if c.URL == "" {
+		return ""
+	}
+	base, err := url.Parse(c.URL)
+	if err != nil {
+		return ""
+	}
+	ref, err := url.Parse(p)
+	if err != nil {
+		return ""
+	}
+	return base.ResolveReference(ref).String()
+}
+
+// ImageURL returns url of image file p, which is relative to html file
+// directory: p resolved relative to BaseURL if it is set, or p itself
+func (c *galleryCache) ImageURL(p string) string {
+	if c.BaseURL == "" {
+		return p
+	}
+	base, err := url.Parse(c.BaseURL)
+	if err != nil {
+		return p
+	}
+	ref, err := url.Parse(p)
+	if err != nil {
+		return p
+	}
+	return base.ResolveReference(ref).String()
+}
+
+// ImageOrigin returns origin, scheme and host, of BaseURL, or an empty string
+// if it is not set, so that browser can be told to connect to it early
+func (c *galleryCache) ImageOrigin() string {
+	u, err := url.Parse(c.BaseURL)
+	if err != nil || c.BaseURL == "" {
+		return ""
+	}
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host}).String()
+}
+
+// setGrid sets Grid and Lightboxes fields; featured images are only left
+// out of the grid with FeaturedApart
+func (c *galleryCache) setGrid() {
+	c.Grid, c.Lightboxes = c.Images, c.Images
+	if !c.FeaturedApart {
+		return
+	}
+	c.Grid = make([]Image, 0, len(c.Images))
+	c.Lightboxes = make([]Image, 0, len(c.Images))
+	for _, img := range c.Images {
+		if img.Featured {
+			c.Lightboxes = append(c.Lightboxes, img)
+		} else {
+			c.Grid = append(c.Grid, img)
+		}
+	}
+	c.Lightboxes = append(c.Lightboxes, c.Grid...)
+}
+
+// Deferred reports whether some grid images are only rendered without
+// scripts, otherwise they're loaded by script after the first Initial ones
+func (c *galleryCache) Deferred() bool { return c.Initial > 0 && len(c.Grid) > c.Initial }
+
+// LightboxInitial returns index of the first of Lightboxes that is deferred
+// along with its grid image, see Deferred
+func (c *galleryCache) LightboxInitial() int { return len(c.Lightboxes) - len(c.Grid) + c.Initial }
+
+// relativizeSources converts Image.Source values of older caches to paths
+// relative to dir; sources outside of dir are kept as is
+func (c *galleryCache) relativizeSources(dir string) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return
+	}
+	for i, img := range c.Images {
+		p, err := filepath.Abs(img.Source)
+		if err != nil {
+			continue
+		}
+		if rel, err := filepath.Rel(dir, p); err == nil && insideDir(dir, p) {
+			c.Images[i].Source = filepath.ToSlash(rel)
+		}
+	}
+	c.RelativeSources = true
+}
+
+// dropBelowRating removes images with Rating less than min
+func (c *galleryCache) dropBelowRating(min int) {
+	images := c.Images[:0]
+	for _, img := range c.Images {
+		if img.Rating >= min {
+			images = append(images, img)
+		}
+	}
+	c.Images = images
+}
+
+// dropSources removes images with Source in set and returns their number
+func (c *galleryCache) dropSources(set map[string]struct{}) int {
+	if len(set) == 0 {
+		return 0
+	}
+	images := c.Images[:0]
+	for _, img := range c.Images {
+		if _, ok := set[img.Source]; !ok {
+			images = append(images, img)
+		}
+	}
+	n := len(c.Images) - len(images)
+	c.Images = images
+	return n
+}
+
+// dropOutside removes images with Time outside of r
+func (c *galleryCache) dropOutside(r timeRange) {
+	images := c.Images[:0]
+	for _, img := range c.Images {
+		if r.contains(img.Time) {
+			images = append(images, img)
+		}
+	}
+	c.Images = images
+}
+
+// SchemaJSON returns schema.org ImageGallery description of the gallery as
+// JSON-LD to be embedded into html; urls are made absolute with AbsURL
+func (c *galleryCache) SchemaJSON() (template.JS, error) {
+	type imageObject struct {
+		Type         string `json:"@type"`
+		ContentURL   string `json:"contentUrl"`
+		ThumbnailURL string `json:"thumbnailUrl"`
+		DateCreated  string `json:"dateCreated"`
+	}
+	out := struct {
+		Context string        `json:"@context"`
+		Type    string        `json:"@type"`
+		Name    string        `json:"name"`
+		URL     string        `json:"url,omitempty"`
+		Images  []imageObject `json:"image"`
+	}{
+		Context: "https://schema.org",
+		Type:    "ImageGallery",
+		Name:    c.Name,
+		URL:     c.URL,
+		Images:  make([]imageObject, len(c.Images)),
+	}
+	for i, img := range c.Images {
+		out.Images[i] = imageObject{
+			Type:         "ImageObject",
+			ContentURL:   c.AbsURL(c.ImageURL(img.Original)),
+			ThumbnailURL: c.AbsURL(c.ImageURL(img.Thumbnail)),
+			DateCreated:  img.Time.Format(time.RFC3339),
+		}
+	}
+	// json.Marshal escapes <, > and &, so output is safe to put inside
+	// script element
+	b, err := json.Marshal(out)
+	if err != nil {
+		return "", err
+	}
+	return template.JS(b), nil
+}
+
+// setPassword sets PasswordSalt and PasswordHash for the given password
+func (c *galleryCache) setPassword(password string) error {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	c.PasswordSalt = hex.EncodeToString(salt)
+	sum := sha256.Sum256([]byte(c.PasswordSalt + password))
+	c.PasswordHash = hex.EncodeToString(sum[:])
+	return nil
+}
+
+// minDiff is a phash distance similarity threshold: phash distance above this
+// threshold are treated as different images, images with phash distance equal
+// or below this threshold are reported as likely duplicates
+const minDiff = 5
+
+func (c *galleryCache) addWithPhash(info Image) error {
+	c.onceSortPhash.Do(func() {
+		sort.SliceStable(c.Images, func(i, j int) bool {
+			return c.Images[i].Hash < c.Images[j].Hash
+		})
+	})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	i := sort.Search(len(c.Images), func(i int) bool { return c.Images[i].Hash >= info.Hash })
+
+	if i == len(c.Images) {
+		if i != 0 {
+			info2 := c.Images[i-1]
+			if diff := phash.Distance(info.Hash, info2.Hash); diff <= minDiff && !c.KeepSimilar && !c.bracketed(info, info2) {
+				return &duplicateError{reason: fmt.Sprintf("possible duplicate (phash similarity distance=%d)", diff), of: info2}
+			}
+		}
+		info.New = true
+		c.Images = append(c.Images, info)
+		c.n++
+		return nil
+	}
+	// bracketed frames may share phash, so all images with it are checked
+	for _, info2 := range c.Images[i:] {
+		if info2.Hash != info.Hash {
+			break
+		}
+		if info2.Source == info.Source && info2.Time.Equal(info.Time) { // attempt to re-add the same image
+			return nil
+		}
+	}
+	if info2 := c.Images[i]; info2.Hash == info.Hash && !c.bracketed(info, info2) {
+		return &duplicateError{reason: "duplicate (same phash)", of: info2}
+	}
+
+	// the index is [i] here, and not [i+1], because this check is *before*
+	// info is inserted into c.Images slice, so an element that would be to its
+	// right is still at position [i]
+	info2 := c.Images[i]
+	if diff := phash.Distance(info.Hash, info2.Hash); diff <= minDiff && !c.KeepSimilar && !c.bracketed(info, info2) {
+		return &duplicateError{reason: fmt.Sprintf("possible duplicate (phash similarity distance=%d)", diff), of: info2}
+	}
+	if i > 0 {
+		info2 = c.Images[i-1]
+		if diff := phash.Distance(info.Hash, info2.Hash); diff <= minDiff && !c.KeepSimilar && !c.bracketed(info, info2) {
+			return &duplicateError{reason: fmt.Sprintf("possible duplicate (phash similarity distance=%d)", diff), of: info2}
+		}
+	}
+
+	for _, h := range info.rotated {
+		if info2, diff, ok := c.closePhash(h); ok {
+			return &duplicateError{reason: fmt.Sprintf("possible rotated duplicate (phash similarity distance=%d)", diff), of: info2}
+		}
+	}
+
+	info.New = true
+	head := c.Images[:i+1]
+	tail := make([]Image, len(c.Images[i:]))
+	copy(tail, c.Images[i:])
+	head[i] = info
+	c.Images = append(head, tail...)
+	c.n++
+	return nil
+}
+
+// bracketWindow is the maximum time span of frames of a single exposure
+// bracketing set
+const bracketWindow = 2 * time.Second
+
+// bracketed reports whether perceptually similar images a and b may be frames
+// of an exposure bracketing set and DedupeBrackets is set, so that both are to
+// be added for dropBrackets to pick one of them
+func (c *galleryCache) bracketed(a, b Image) bool {
+	if !c.DedupeBrackets || a.ExposureBias == b.ExposureBias {
+		return false
+	}
+	d := a.Time.Sub(b.Time)
+	return -bracketWindow <= d && d <= bracketWindow
+}
+
+// dropBrackets removes all frames of exposure bracketing sets except the
+// middle exposure ones and returns removed images. Set is a series of images
+// taken within bracketWindow, perceptually similar to its first image and
+// having different exposure biases. It expects Images to be already sorted by
+// sortByTime and Hash to be perceptual.
+func (c *galleryCache) dropBrackets() []Image {
+	var dropped []Image
+	images := make([]Image, 0, len(c.Images))
+	for i := 0; i < len(c.Images); {
+		first := c.Images[i]
+		j := i + 1
+		for ; j < len(c.Images); j++ {
+			img := c.Images[j]
+			if first.Time.Sub(img.Time) > bracketWindow || phash.Distance(first.Hash, img.Hash) > minDiff {
+				break
+			}
+		}
+		set := append([]Image(nil), c.Images[i:j]...)
+		i = j
+		var bracketed bool
+		for _, img := range set[1:] {
+			bracketed = bracketed || img.ExposureBias != first.ExposureBias
+		}
+		if !bracketed {
+			images = append(images, set...)
+			continue
+		}
+		sort.SliceStable(set, func(i, j int) bool { return set[i].ExposureBias < set[j].ExposureBias })
+		mid := (len(set) - 1) / 2
+		images = append(images, set[mid])
+		dropped = append(dropped, set[:mid]...)
+		dropped = append(dropped, set[mid+1:]...)
+	}
+	c.Images = images
+	return dropped
+}
+
+// stackWindow is the maximum time between consecutive frames of a burst
+const stackWindow = 5 * time.Second
+
+// setStacks groups bursts: series of images each taken within stackWindow of
+// the previous one and perceptually similar to it. The first, newest, image
+// of a burst represents it and gets the rest in its Stack, they get its ID in
+// StackOf. It expects Images to be already sorted by time, newest first.
+func (c *galleryCache) setStacks() {
+	for i := 0; i < len(c.Images); {
+		j := i + 1
+		for ; j < len(c.Images); j++ {
+			prev, img := c.Images[j-1], c.Images[j]
+			if prev.Time.Sub(img.Time) > stackWindow || phash.Distance(prev.Hash, img.Hash) > minDiff {
+				break
+			}
+		}
+		if j-i > 1 {
+			id := c.Images[i].ID()
+			for k := i + 1; k < j; k++ {
+				c.Images[k].StackOf = id
+			}
+			c.Images[i].Stack = append([]Image(nil), c.Images[i+1:j]...)
+		}
+		i = j
+	}
+}
+
+// closePhash returns image with phash similarity distance to h not above
+// minDiff, if there is one among images next to where h would be inserted.
+// c.mu must be held and Images must be sorted by Hash.
+func (c *galleryCache) closePhash(h uint64) (Image, int, bool) {
+	i := sort.Search(len(c.Images), func(i int) bool { return c.Images[i].Hash >= h })
+	for _, j := range []int{i - 1, i} {
+		if j < 0 || j >= len(c.Images) {
+			continue
+		}
+		if diff := phash.Distance(h, c.Images[j].Hash); diff <= minDiff {
+			return c.Images[j], diff, true
+		}
+	}
+	return Image{}, 0, false
+}
+
+func (c *galleryCache) add(info Image) error {
+	if c.hasher.Perceptual() {
+		return c.addWithPhash(info)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.dups == nil {
+		c.dups = make(map[string]string, len(c.Images))
+		for _, info := range c.Images {
+			c.dups[info.key()] = info.Source
+		}
+	}
+	if s, ok := c.dups[info.key()]; ok {
+		if s == info.Source { // same image, ok to skip
+			return nil
+		}
+		return &sameContentError{id: info.ID(), source: s}
+	}
+	info.New = true
+	c.Images = append(c.Images, info)
+	c.dups[info.key()] = info.Source
+	c.n++
+	return nil
+}
+
+// sameContentError is returned by add for an image with the same content hash
+// as an image from another source
+type sameContentError struct {
+	id     string // image id
+	source string // source of already added image
+}
+
+func (e *sameContentError) Error() string {
+	return fmt.Sprintf("gallery already has image with id %q: %q (original file name)", e.id, e.source)
+}
+
+// duplicateError is returned by addWithPhash for an image perceptually
+// identical or similar to an already added one
+type duplicateError struct {
+	reason string // like "duplicate (same phash)"
+	of     Image  // already added image
+}
+
+func (e *duplicateError) Error() string {
+	return fmt.Sprintf("%s of %q (source filename %q)", e.reason, e.of.Original, e.of.Source)
+}
+
+// isDuplicate reports whether err returned by add is about an image being a
+// duplicate or a likely duplicate of an already added one
+func isDuplicate(err error) bool {
+	var same *sameContentError
+	var similar *duplicateError
+	return errors.As(err, &same) || errors.As(err, &similar)
+}
+
+// loadCache reads cache from file. Images are decoded one by one, so that
+// memory is not spent on buffering the whole, possibly huge, array.
+func loadCache(name string) (*galleryCache, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(bufio.NewReader(f))
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+	cache := &galleryCache{}
+	fields := make(map[string]json.RawMessage)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected json token %v", tok)
+		}
+		if !strings.EqualFold(key, "Images") {
+			var v json.RawMessage
+			if err := dec.Decode(&v); err != nil {
+				return nil, err
+			}
+			fields[key] = v
+			continue
+		}
+		if tok, err := dec.Token(); err != nil {
+			return nil, err
+		} else if tok == nil { // null
+			continue
+		} else if d, ok := tok.(json.Delim); !ok || d != '[' {
+			return nil, fmt.Errorf("unexpected json token %v", tok)
+		}
+		for dec.More() {
+			var img Image
+			if err := dec.Decode(&img); err != nil {
+				return nil, err
+			}
+			cache.Images = append(cache.Images, img)
+		}
+		if err := expectDelim(dec, ']'); err != nil {
+			return nil, err
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, err
+	}
+	// remaining fields are few, decode them as a regular object
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, cache); err != nil {
+		return nil, err
+	}
+	return cache, nil
+}
+
+// expectDelim reads the next json token and checks that it is delimiter d
+func expectDelim(dec *json.Decoder, d json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != d {
+		return fmt.Errorf("unexpected json token %v, want %v", tok, d)
+	}
+	return nil
+}
+
+// writeCache writes cache as indented json, same as json.Encoder with "\t"
+// indent would do. Images are encoded one by one, so that encoded form of the
+// whole array is never held in memory.
+func writeCache(w io.Writer, cache *galleryCache) error {
+	images := cache.Images
+	cache.Images = nil
+	b, err := json.MarshalIndent(cache, "", "\t")
+	cache.Images = images
+	if err != nil {
+		return err
+	}
+	// top-level key is the only place this can be found at: newlines and
+	// quotes inside of encoded strings are escaped
+	const placeholder = "\n\t\"Images\": null"
+	if bytes.Count(b, []byte(placeholder)) != 1 {
+		return errors.New("cannot find images in encoded cache")
+	}
+	i := bytes.Index(b, []byte(placeholder))
+	bw := bufio.NewWriter(w)
+	bw.Write(b[:i+len(placeholder)-len("null")])
+	switch {
+	case images == nil:
+		bw.WriteString("null")
+	case len(images) == 0:
+		bw.WriteString("[]")
+	default:
+		bw.WriteString("[\n")
+		for j := range images {
+			b, err := json.MarshalIndent(&images[j], "\t\t", "\t")
+			if err != nil {
+				return err
+			}
+			bw.WriteString("\t\t")
+			bw.Write(b)
+			if j < len(images)-1 {
+				bw.WriteByte(',')
+			}
+			bw.WriteByte('\n')
+		}
+		bw.WriteString("\t]")
+	}
+	bw.Write(b[i+len(placeholder):])
+	bw.WriteByte('\n')
+	return bw.Flush()
+}
+
+// checkpoint saves cache while images may still be added concurrently
+func (c *galleryCache) checkpoint(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return saveCache(c, name)
+}
+
+func saveCache(cache *galleryCache, name string) error {
+	tf, err := ioutil.TempFile(filepath.Dir(name), "photo-gallery-cache-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer tf.Close()
+	var defuse bool
+	defer func() {
+		if !defuse {
+			_ = os.Remove(tf.Name())
+		}
+	}()
+	if err := writeCache(tf, cache); err != nil {
+		return err
+	}
+	if err := tf.Close(); err != nil {
+		return err
+	}
+	defuse = true
+	return os.Rename(tf.Name(), name)
+}
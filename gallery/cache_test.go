@@ -0,0 +1,101 @@
+package gallery
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCacheFormat(t *testing.T) {
+	images := []Image{
+		{
+			Portrait: true, Tags: []string{"sea", "<b>&"}, Title: "Sunset \"at\" sea",
+			Camera: "Camera X", Exposure: "1/250 s, f/4", Rating: 3, Featured: true,
+			Original: "o/abc.jpg", Medium: "t/abc-medium.jpg", Thumbnail: "t/abc.jpg",
+			Width: 333, Height: 500, Source: "2024/sunset.jpg", Hash: 1<<64 - 1,
+			Time: time.Date(2024, 1, 15, 10, 22, 33, 0, time.FixedZone("", 2*60*60)),
+		},
+		{
+			Animated: true, Hidden: true, Rating: -1, Original: "o/def.jpg", Thumbnail: "t/def.jpg",
+			Source: "../other/anim.gif", Hash: 42, Digest: "00112233445566778899aabbccddeeff",
+			Time: time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC), ExposureBias: -0.7,
+		},
+	}
+	table := []struct {
+		name  string
+		cache *galleryCache
+	}{
+		{"no images", &galleryCache{Name: "Gallery", HashFunc: HashFNV}},
+		{"empty images", &galleryCache{Name: "Gallery", HashFunc: HashFNV, Images: []Image{}}},
+		{"one image", &galleryCache{Name: "Gallery", HashFunc: HashFNV, Images: images[:1]}},
+		{"images", &galleryCache{
+			Name: "Trips", Footer: "footer", URL: "https://example.com/", TimeFrom: TimeFromExif,
+			HashFunc: HashPhash, UsePhash: true, Description: "a description",
+			TemplateHash: "0123", RelativeSources: true, Images: images,
+		}},
+		// name that looks like images key once encoded
+		{"tricky name", &galleryCache{Name: "x\",\n\t\"Images\": null", Images: images}},
+	}
+	dir := t.TempDir()
+	for i, tc := range table {
+		// file written by json.Encoder, as caches were written before
+		// images were streamed
+		var old bytes.Buffer
+		enc := json.NewEncoder(&old)
+		enc.SetIndent("", "\t")
+		if err := enc.Encode(tc.cache); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := writeCache(&buf, tc.cache); err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !bytes.Equal(buf.Bytes(), old.Bytes()) {
+			t.Errorf("%s: writeCache output differs from json.Encoder one:\n%s\nwant:\n%s", tc.name, buf.Bytes(), old.Bytes())
+		}
+		var decoded galleryCache
+		if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+			t.Errorf("%s: decoding writeCache output: %v", tc.name, err)
+		} else if !equalCaches(&decoded, tc.cache) {
+			t.Errorf("%s: writeCache output decoded to a different cache", tc.name)
+		}
+		name := filepath.Join(dir, "cache"+string(rune('a'+i))+".json")
+		if err := ioutil.WriteFile(name, old.Bytes(), 0666); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := loadCache(name)
+		if err != nil {
+			t.Errorf("%s: loading json.Encoder output: %v", tc.name, err)
+		} else if !equalCaches(loaded, tc.cache) {
+			t.Errorf("%s: json.Encoder output loaded as a different cache", tc.name)
+		}
+	}
+}
+
+// equalCaches reports whether persisted fields of caches are equal; empty
+// and nil image lists are considered equal, as the latter is what loadCache
+// produces for both
+func equalCaches(a, b *galleryCache) bool {
+	if len(a.Images) != len(b.Images) {
+		return false
+	}
+	for i := range a.Images {
+		x, y := a.Images[i], b.Images[i]
+		if !x.Time.Equal(y.Time) {
+			return false
+		}
+		x.Time, y.Time = time.Time{}, time.Time{}
+		if !reflect.DeepEqual(x, y) {
+			return false
+		}
+	}
+	imagesA, imagesB := a.Images, b.Images
+	a.Images, b.Images = nil, nil
+	defer func() { a.Images, b.Images = imagesA, imagesB }()
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,76 @@
+package gallery
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Check verifies integrity of a previously generated gallery described by
+// args.Cache, resolved the same way Generate does, without changing anything.
+// It returns descriptions of found problems:
+//
+//   - thumbnail, medium or full size image of a gallery image is missing;
+//   - a file in ThumbsDir or FullsizeDir is not referenced by any image;
+//   - source file of an image no longer exists.
+//
+// Sources stored relative to source directory are only checked if
+// args.SrcDirs is set.
+func Check(args Options) ([]string, error) {
+	if args.Cache == "" {
+		return nil, errors.New("metadata cache must be set to check gallery")
+	}
+	page, err := loadCache(args.cacheFile())
+	if err != nil {
+		return nil, err
+	}
+	var problems []string
+	root := filepath.Dir(args.HTML)
+	known := make(map[string]struct{}, 2*len(page.Images))
+	for _, img := range page.Images {
+		for _, p := range img.files() {
+			name, err := filepath.Abs(filepath.Join(root, filepath.FromSlash(p)))
+			if err != nil {
+				return nil, err
+			}
+			known[name] = struct{}{}
+			if _, err := os.Stat(name); err != nil {
+				problems = append(problems, fmt.Sprintf("image %s: %v", img.ID(), err))
+			}
+		}
+		src := filepath.FromSlash(img.Source)
+		switch {
+		case !page.RelativeSources || filepath.IsAbs(src):
+		case len(args.SrcDirs) != 0:
+			src = filepath.Join(args.SrcDirs[0], src)
+		default:
+			continue
+		}
+		if _, err := os.Stat(src); err != nil {
+			problems = append(problems, fmt.Sprintf("image %s source: %v", img.ID(), err))
+		}
+	}
+	for _, dir := range []string{args.ThumbsDir, args.FullsizeDir} {
+		walkFunc := func(p string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+			if info.Name() == OutputMarker {
+				return nil
+			}
+			name, err := filepath.Abs(p)
+			if err != nil {
+				return err
+			}
+			if _, ok := known[name]; !ok {
+				problems = append(problems, fmt.Sprintf("%s is not referenced by any image", p))
+			}
+			return nil
+		}
+		if err := filepath.Walk(dir, walkFunc); err != nil {
+			return nil, err
+		}
+	}
+	return problems, nil
+}
@@ -0,0 +1,72 @@
+package gallery
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// writeChecksums writes SHA-256 checksums of image thumbnails, medium size and
+// full size copies to file name in a format of sha256sum tool. Image paths are relative
+// to root, and so are paths in the file.
+//
+// Checksums are computed from files on disk rather than while writing them,
+// as most of them are usually hardlinked or left from previous runs.
+func writeChecksums(name, root string, images []Image) error {
+	paths := make([]string, 0, 2*len(images))
+	for _, img := range images {
+		paths = append(paths, img.files()...)
+	}
+	sums := make([][]byte, len(paths))
+	workers := runtime.GOMAXPROCS(0)
+	var group errgroup.Group
+	for w := 0; w < workers; w++ {
+		w := w
+		group.Go(func() error {
+			for i := w; i < len(paths); i += workers {
+				sum, err := fileSHA256(filepath.Join(root, filepath.FromSlash(paths[i])))
+				if err != nil {
+					return err
+				}
+				sums[i] = sum
+			}
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return err
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	for i, p := range paths {
+		fmt.Fprintf(w, "%x  %s\n", sums[i], p)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// fileSHA256 returns SHA-256 checksum of file content
+func fileSHA256(name string) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
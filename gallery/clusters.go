@@ -0,0 +1,54 @@
+package gallery
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/artyom/phash"
+)
+
+// similarClusters groups perceptually similar images: images are ordered by
+// phash, and each one whose phash distance to its predecessor is within
+// minDiff joins the predecessor's group. Groups of a single image are not
+// returned.
+func similarClusters(images []Image) [][]Image {
+	sorted := append([]Image(nil), images...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Hash < sorted[j].Hash })
+	var out [][]Image
+	for i := 0; i < len(sorted); {
+		j := i + 1
+		for j < len(sorted) && phash.Distance(sorted[j-1].Hash, sorted[j].Hash) <= minDiff {
+			j++
+		}
+		if j-i > 1 {
+			out = append(out, sorted[i:j])
+		}
+		i = j
+	}
+	return out
+}
+
+// writeClusters writes sources of perceptually similar images to file name,
+// one per line, with groups separated by empty lines
+func writeClusters(name string, clusters [][]Image) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	for i, c := range clusters {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		for _, img := range c {
+			fmt.Fprintln(w, img.Source)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
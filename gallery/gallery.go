@@ -0,0 +1,1845 @@
+// Package gallery implements a simple web photo gallery generator.
+//
+// Generate takes a directory with images and produces HTML file along with two
+// directories: one holds full-sized copies of original photos, another
+// contains thumbnails. These directories + an HTML file are compatible with
+// any web server supporting static content.
+package gallery
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/sync/errgroup"
+)
+
+// Options configure gallery generation
+type Options struct {
+	SrcDirs     []string // source image directories, walked in the given order
+	FullsizeDir string   // destination directory for full size images
+	ThumbsDir   string   // generated thumbnails directory
+	HTML        string   // destination html file
+
+	Template string // optional template file to override default
+	Cache    string // optional gallery metadata cache, bare name is relative to HTML directory
+	Name     string // optional gallery name
+	Footer   string // optional footer text
+	CSS      string // optional css file to inline into html
+	CSSHref  string // optional stylesheet url
+	Favicon  string // optional icon file to inline into html
+	URL      string // optional public url of html file
+	BaseURL  string // optional url of html file directory on another origin to load images from, see ImageURL
+	Password string // optional password for client-side check, see passwordGateTemplate
+	TimeFrom string // optional image time source, one of TimeSources
+	TZ       string // optional IANA time zone name for image times
+	Since    string // optional earliest image time, RFC3339 or date, see parseTimeRange
+	Until    string // optional latest image time, RFC3339 or date, see parseTimeRange
+	Hash     string // optional hash function name, one of HashFuncs
+	Phash    bool   // whether to use (slower) perceptual image hash, same as Hash=HashPhash
+
+	// Description is an optional gallery description for search engines and
+	// link previews, a summary of images is used if it is not set
+	Description string
+
+	// PhashRotations makes perceptual hash duplicate detection also compare
+	// images rotated by 90, 180 and 270 degrees, which is 4 times slower
+	PhashRotations bool
+
+	// DedupeBrackets makes perceptual hash duplicate detection keep only the
+	// middle exposure frame of each exposure bracketing set: images taken
+	// within 2 seconds, looking similar and having different EXIF exposure
+	// bias. Frames with the same perceptual hash share output files, so the
+	// kept frame may be shown with pixels of another one from its set.
+	DedupeBrackets bool
+
+	Permalinks   bool   // whether to generate per-image html pages
+	IDScheme     string // optional image id scheme, one of IDSchemes
+	Minify       bool   // whether to strip comments and insignificant whitespace from html
+	NoIndex      bool   // whether to ask search engines not to index pages
+	Schema       bool   // whether to embed schema.org metadata, requires URL
+	Eager        int    // number of first thumbnails preloaded and loaded eagerly with high priority, others are lazy
+	GridMinWidth int    // minimum width of grid columns in pixels, default is DefaultGridMinWidth
+	Layout       string // optional thumbnails layout, one of Layouts
+	Spans        bool   // whether panoramas span two grid columns, see Image.Panorama
+	MarkNew      bool   // whether images added during this run get a "new" badge, see Image.New
+	ForceThumbs  bool   // whether to overwrite existing thumbnails
+	Filter       string // optional thumbnail resampling filter name, one of FilterNames
+	VerifyLinks  bool   // whether to check existing full size copies match their sources
+	Copy         bool   // whether to always copy full size images instead of hardlinking them
+	Shard        bool   // whether to spread output files over subdirectories
+	ThumbSquare  bool   // whether to crop thumbnails to squares
+	SRGB         bool   // whether to convert colors of images with embedded color profiles to sRGB
+	MinRating    int    // if not zero, images with lower XMP rating are skipped, unrated images have rating 0
+
+	// FeaturedApart makes featured images, see FeaturedSuffix, shown only
+	// in the featured section, rather than in the grid too
+	FeaturedApart bool
+
+	// Sharpen is sigma of unsharp mask applied to thumbnails and medium size
+	// images after resizing; zero means DefaultSharpen, negative disables it
+	Sharpen float64
+
+	// ThumbBackground is an optional color in #rrggbb notation to fill
+	// transparent areas of images converted to jpeg with, default is white
+	ThumbBackground string
+
+	// EmbeddedThumbs makes thumbnails of jpeg images from thumbnails
+	// embedded into their EXIF if those are large enough, which is much
+	// faster than decoding whole images, but yields lower quality
+	EmbeddedThumbs bool
+
+	// OrientOriginals makes full size copies of images with EXIF orientation
+	// re-encoded with orientation applied, instead of linking or copying
+	// them. Existing copies are kept as is.
+	OrientOriginals bool
+
+	// MaxOutputBytes, if positive, limits total size of thumbnails and full
+	// size images: the newest images fitting the limit are kept, files of
+	// older ones are removed and they are omitted from the gallery
+	MaxOutputBytes int64
+
+	// MaxDestPixels, if positive, is the maximum number of pixels of
+	// created thumbnails and medium size images, default is
+	// DefaultMaxDestPixels. Either of their dimensions must also be below
+	// 65536. This guards against settings allocating huge images.
+	MaxDestPixels int
+
+	// Safe makes generation refuse to write into non-empty output
+	// directories without OutputMarker file, which is written into output
+	// directories on every run, to protect unrelated files from mistyped
+	// paths
+	Safe bool
+
+	// Bundle is an optional zip file to write html file, thumbnails and full
+	// size images into, instead of leaving them in their directories. Paths
+	// inside archive are relative to html file directory. Files are not
+	// streamed into the archive: the gallery is generated into a temporary
+	// directory next to Bundle first, as thumbnails are read back after
+	// being written, e.g. for their sizes and checksums. Full size images
+	// are hardlinked there if sources are on the same filesystem, otherwise
+	// up to twice the gallery size of disk space is needed.
+	Bundle string
+
+	// Checksums is an optional file to write SHA-256 checksums of
+	// thumbnails and full size images to, in sha256sum tool format; paths
+	// there are relative to html file directory
+	Checksums string
+
+	// Clusters is an optional file to write groups of perceptually similar
+	// image sources to, for manual review. If set, similar images are added
+	// to the gallery instead of being reported as possible duplicates.
+	// Requires perceptual hash.
+	Clusters string
+
+	// Stacks makes bursts, series of perceptually similar images taken
+	// within a few seconds of each other, shown as a single thumbnail with
+	// a count badge, which reveals the rest of the burst on click. Similar
+	// images are added to the gallery instead of being reported as possible
+	// duplicates, but ones with the same perceptual hash still are, as they
+	// would share output files. Requires perceptual hash.
+	Stacks bool
+
+	// Sniff makes files with unknown or no extension to be checked for being
+	// images of supported formats by their leading bytes. Camera raw files
+	// are skipped: many of them are TIFF-based, but cannot be decoded.
+	Sniff bool
+
+	// Stamp makes html file end with a comment telling version of the
+	// program and time it was generated at
+	Stamp bool
+
+	// MediumMaxDim, if positive, is the maximum width and height of medium
+	// size images, created in ThumbsDir for images larger than that, to be
+	// shown instead of full size ones, which are still linked for download
+	MediumMaxDim int
+
+	// Initial, if positive, is the number of images rendered on the page as
+	// usual; the rest are kept in noscript elements, which is inert text
+	// for browsers with scripts enabled, and are added by script as the
+	// page is scrolled to its end
+	Initial int
+
+	// Deterministic makes images be added to the gallery, which is where
+	// duplicates are detected, in order of their source paths after all of
+	// them are processed, rather than in order workers finish them. This
+	// makes output of runs over the same sources identical at the cost of
+	// reporting duplicates only after all thumbnails are created.
+	Deterministic bool
+
+	// AllowDupNames makes images with the same content as already added
+	// ones from other sources skipped rather than reported as errors; it
+	// only applies to content hashes, not perceptual one
+	AllowDupNames bool
+
+	// OnDuplicate is a policy for images that are duplicates or likely
+	// duplicates of already added ones, one of DuplicatePolicies, default
+	// is DuplicateError. Images with the same content from other sources
+	// are skipped with AllowDupNames regardless of it. Of images with the
+	// same phash found in one run, the one processed first is kept; with
+	// Deterministic, it is the one with the first source path, but then
+	// creating files has to wait for all images to be hashed.
+	OnDuplicate string
+
+	// IOJobs and CPUJobs, if positive, are numbers of workers reading,
+	// filtering and hashing source files, and of workers creating their
+	// thumbnails and full size copies; both default to GOMAXPROCS.
+	// Perceptual hash is computed by the former too.
+	IOJobs  int
+	CPUJobs int
+
+	// Checkpoint, if positive, makes Cache saved after every Checkpoint
+	// added images, so that a run that is killed or fails keeps metadata
+	// of images processed before. It requires Cache and has no effect with
+	// Deterministic, which adds images only after all are processed.
+	Checkpoint int
+
+	// DirMode and FileMode, if set, are permissions of created directories
+	// and files; otherwise defaults limited by umask are used. Full size
+	// images hardlinked to sources keep their permissions.
+	DirMode  os.FileMode
+	FileMode os.FileMode
+
+	// ContactSheet is an optional contact sheet jpeg file with ContactCols
+	// columns; large contact sheets are split into several files with
+	// "-2", "-3" and so on added to the name before the extension
+	ContactSheet string
+	ContactCols  int
+
+	// Logf, if set, is used to report progress and non-fatal issues
+	Logf func(format string, v ...interface{}) `json:"-"`
+	// LogEvent, if set, is used instead of Logf, getting the same reports
+	// as structured events
+	LogEvent func(Event) `json:"-"`
+	// Verbose enables reporting of details, like why image time could
+	// not be taken from EXIF, with Logf
+	Verbose bool
+}
+
+// Event is a progress or non-fatal issue report, see Options.LogEvent
+type Event struct {
+	Type  string // one of Event constants
+	File  string // file event is about, if any
+	Count int    // number of images or files event is about, if any
+	Text  string // human-readable description, as passed to Options.Logf
+}
+
+// Event types, see Event.Type
+const (
+	EventMessage   = "message"   // anything not covered by other types
+	EventProgress  = "progress"  // number of source files processed so far
+	EventSkipped   = "skipped"   // source file is not added to the gallery
+	EventOmitted   = "omitted"   // number of images left out of html
+	EventRecreated = "recreated" // file is recreated by Repair
+)
+
+// event reports event of type typ about file and count of images or files,
+// with text formatted from format and v
+func (a *Options) event(typ, file string, count int, format string, v ...interface{}) {
+	switch {
+	case a.LogEvent != nil:
+		a.LogEvent(Event{Type: typ, File: file, Count: count, Text: fmt.Sprintf(format, v...)})
+	case a.Logf != nil:
+		a.Logf(format, v...)
+	}
+}
+
+// vevent is like event, but only reports if Verbose is set
+func (a *Options) vevent(typ, file string, count int, format string, v ...interface{}) {
+	if a.Verbose {
+		a.event(typ, file, count, format, v...)
+	}
+}
+
+func (a *Options) logf(format string, v ...interface{}) {
+	a.event(EventMessage, "", 0, format, v...)
+}
+
+// vlogf is like logf, but only reports if Verbose is set
+func (a *Options) vlogf(format string, v ...interface{}) {
+	if a.Verbose {
+		a.logf(format, v...)
+	}
+}
+
+// thumbOptions returns options of thumbnails and medium size images
+func (a *Options) thumbOptions() (thumb, medium thumbOptions, err error) {
+	limit := a.MaxDestPixels
+	if limit == 0 {
+		limit = DefaultMaxDestPixels
+	}
+	tr, err := newTransform(0, 0, 500, 500, limit)
+	if err != nil {
+		return thumb, medium, fmt.Errorf("thumbnail size: %w", err)
+	}
+	sharpen := a.Sharpen
+	if sharpen == 0 {
+		sharpen = DefaultSharpen
+	}
+	thumb = thumbOptions{transform: tr, Force: a.ForceThumbs, Filter: Filters[DefaultFilter],
+		Square: a.ThumbSquare, Background: color.White, Embedded: a.EmbeddedThumbs, Sharpen: sharpen,
+		SRGB: a.SRGB}
+	if a.Filter != "" {
+		thumb.Filter = Filters[a.Filter]
+	}
+	if a.ThumbBackground != "" {
+		if thumb.Background, err = parseColor(a.ThumbBackground); err != nil {
+			return thumb, medium, err
+		}
+	}
+	medium = thumb
+	medium.Square, medium.Embedded = false, false
+	if a.MediumMaxDim > 0 {
+		if medium.transform, err = newTransform(0, 0, a.MediumMaxDim, a.MediumMaxDim, limit); err != nil {
+			return thumb, medium, fmt.Errorf("medium size images: %w", err)
+		}
+	}
+	return thumb, medium, nil
+}
+
+// reorient reports whether full size copy of jpeg image p is to be converted
+// to have its orientation applied, rather than linked or copied as is. Images
+// with non-default orientation are converted with OrientOriginals, as not
+// every viewer respects EXIF; so are ones with XMP orientation xmpOrientation
+// differing from EXIF one, as viewers would apply the latter.
+func (a *Options) reorient(p string, xmpOrientation int) bool {
+	if !a.OrientOriginals && xmpOrientation == 0 {
+		return false // avoid reading the file
+	}
+	o := fileOrientation(p)
+	if o == 0 {
+		o = 1
+	}
+	overridden := xmpOrientation != 0 && xmpOrientation != o
+	return overridden || a.OrientOriginals && o > 1
+}
+
+func (a *Options) validate() error {
+	if len(a.SrcDirs) == 0 {
+		return errors.New("source directory must be set")
+	}
+	if a.FullsizeDir == "" {
+		return errors.New("destination directory must be set")
+	}
+	if a.ThumbsDir == "" {
+		return errors.New("thumbnails directory must be set")
+	}
+	if a.HTML == "" {
+		return errors.New("output html file must be set")
+	}
+	if a.TimeFrom != "" && !validTimeSource(a.TimeFrom) {
+		return fmt.Errorf("unsupported time source %q, valid values are: %s", a.TimeFrom, strings.Join(TimeSources, ", "))
+	}
+	if a.TZ != "" {
+		if _, err := time.LoadLocation(a.TZ); err != nil {
+			return fmt.Errorf("invalid time zone: %w", err)
+		}
+	}
+	if _, err := parseTimeRange(a.Since, a.Until, time.UTC); err != nil {
+		return err
+	}
+	if a.Hash != "" {
+		if _, ok := hashers[a.Hash]; !ok {
+			return fmt.Errorf("unsupported hash function %q, valid values are: %s", a.Hash, strings.Join(HashFuncs, ", "))
+		}
+		if a.Phash && a.Hash != HashPhash {
+			return fmt.Errorf("perceptual hash cannot be used together with %q hash function", a.Hash)
+		}
+	}
+	if _, ok := Filters[a.Filter]; a.Filter != "" && !ok {
+		return fmt.Errorf("unsupported filter %q, valid values are: %s", a.Filter, strings.Join(FilterNames, ", "))
+	}
+	if a.URL != "" {
+		if u, err := url.Parse(a.URL); err != nil || !u.IsAbs() {
+			return errors.New("gallery url must be an absolute url")
+		}
+	}
+	if a.BaseURL != "" {
+		if u, err := url.Parse(a.BaseURL); err != nil || !u.IsAbs() {
+			return errors.New("base url must be an absolute url")
+		} else if u.RawQuery != "" || u.Fragment != "" {
+			return errors.New("base url must not have query or fragment")
+		}
+	}
+	if a.ThumbBackground != "" {
+		if _, err := parseColor(a.ThumbBackground); err != nil {
+			return err
+		}
+	}
+	if a.OnDuplicate != "" && a.OnDuplicate != DuplicateError && a.OnDuplicate != DuplicateWarn && a.OnDuplicate != DuplicateSkip {
+		return fmt.Errorf("unsupported duplicate policy %q, valid values are: %s", a.OnDuplicate, strings.Join(DuplicatePolicies, ", "))
+	}
+	if a.Layout != "" && a.Layout != LayoutGrid && a.Layout != LayoutMasonry && a.Layout != LayoutJustified {
+		return fmt.Errorf("unsupported layout %q, valid values are: %s", a.Layout, strings.Join(Layouts, ", "))
+	}
+	if a.IDScheme != "" && a.IDScheme != IDSchemeHash && a.IDScheme != IDSchemeSequential {
+		return fmt.Errorf("unsupported id scheme %q, valid values are: %s", a.IDScheme, strings.Join(IDSchemes, ", "))
+	}
+	if a.DirMode&^os.ModePerm != 0 || a.FileMode&^os.ModePerm != 0 {
+		return errors.New("only permission bits can be set in file modes")
+	}
+	if math.IsNaN(a.Sharpen) || math.IsInf(a.Sharpen, 0) {
+		return errors.New("sharpening sigma must be a finite number")
+	}
+	if a.MaxDestPixels < 0 {
+		return errors.New("destination pixels limit cannot be negative")
+	}
+	if a.MaxOutputBytes < 0 {
+		return errors.New("output size limit cannot be negative")
+	}
+	if a.Initial < 0 {
+		return errors.New("number of initial images cannot be negative")
+	}
+	if a.IOJobs < 0 || a.CPUJobs < 0 {
+		return errors.New("number of workers cannot be negative")
+	}
+	if a.Checkpoint < 0 {
+		return errors.New("checkpoint interval cannot be negative")
+	}
+	if a.Checkpoint > 0 && a.Cache == "" {
+		return errors.New("checkpoints require metadata cache")
+	}
+	if a.MediumMaxDim < 0 {
+		return errors.New("medium size image dimension cannot be negative")
+	}
+	if a.GridMinWidth < 0 {
+		return errors.New("grid column width must be positive")
+	}
+	if a.Eager < 0 {
+		return errors.New("number of eagerly loaded thumbnails cannot be negative")
+	}
+	if a.ContactSheet != "" && a.ContactCols < 1 {
+		return errors.New("contact sheet should have at least one column")
+	}
+	if a.ContactSheet != "" && a.ContactCols > maxContactCols {
+		return fmt.Errorf("contact sheet cannot have more than %d columns", maxContactCols)
+	}
+	if filepath.Clean(a.FullsizeDir) == filepath.Clean(a.ThumbsDir) {
+		return errors.New("destination and thumbnail directories cannot be the same")
+	}
+	for _, dir := range a.SrcDirs {
+		if filepath.Clean(dir) == filepath.Clean(a.ThumbsDir) {
+			return errors.New("source and thumbnail directories cannot be the same")
+		}
+	}
+	// thumbnails and full size images are referenced from html by paths
+	// relative to html file directory, so any layout filepath.Rel can express
+	// is fine
+	dir := filepath.Dir(a.HTML)
+	if _, err := filepath.Rel(dir, a.ThumbsDir); err != nil {
+		return fmt.Errorf("thumbnails directory cannot be referenced relative to html file: %w", err)
+	}
+	if _, err := filepath.Rel(dir, a.FullsizeDir); err != nil {
+		return fmt.Errorf("destination directory cannot be referenced relative to html file: %w", err)
+	}
+	if a.Bundle != "" {
+		if a.Cache != "" {
+			// bundle is written from scratch on each run, while cache
+			// refers to previously written files
+			return errors.New("bundle cannot be used together with metadata cache")
+		}
+		if !insideDir(dir, a.ThumbsDir) || !insideDir(dir, a.FullsizeDir) {
+			return errors.New("to write a bundle, thumbnails and destination directories must be inside html file directory")
+		}
+	}
+	return nil
+}
+
+// cacheFile returns path of the metadata cache file. A bare file name, like
+// ".cache.json", is resolved relative to html file directory, so the cache is
+// kept next to the gallery it describes; any other path, absolute or relative
+// (e.g. "./cache.json"), is used as is.
+func (a Options) cacheFile() string {
+	if a.Cache == "" || filepath.Base(a.Cache) != a.Cache {
+		return a.Cache
+	}
+	return filepath.Join(filepath.Dir(a.HTML), a.Cache)
+}
+
+// Result describes generated gallery
+type Result struct {
+	Added  int     // number of images added to the gallery during this run
+	Images []Image // all gallery images, newest first
+	Stats  Stats   // files written during this run
+	Timing Timing  // time spent in generation stages
+}
+
+// Timing describes time spent in generation stages. Stages run by parallel
+// workers have their time summed over workers, so it can exceed Total.
+type Timing struct {
+	Total      time.Duration // whole generation
+	Walk       time.Duration // walking source directories, including waits for busy workers
+	Hash       time.Duration // computing image hashes
+	Thumbnails time.Duration // creating thumbnails and medium size images
+	Fullsize   time.Duration // linking, copying or converting full size images
+	Render     time.Duration // rendering html files
+}
+
+// since adds time passed since start to d, it is safe for concurrent use
+func (t *Timing) since(d *time.Duration, start time.Time) {
+	atomic.AddInt64((*int64)(d), int64(time.Since(start)))
+}
+
+// Stats describes files written and skipped during gallery generation
+type Stats struct {
+	ThumbnailBytes int64 // total size of created thumbnails and medium size images
+	FullsizeBytes  int64 // total size of full size images copied or converted
+	Linked         int64 // number of full size images hardlinked to sources
+	Copied         int64 // number of full size images copied or converted
+	NotImages      int64 // number of skipped source files that are empty or not images, see isImageFile
+	Duplicates     int64 // number of images skipped as duplicates, see Options.OnDuplicate
+}
+
+func (s *Stats) addThumbnail(n int64) { atomic.AddInt64(&s.ThumbnailBytes, n) }
+
+func (s *Stats) addFullsize(mode copyMode, n int64) {
+	switch mode {
+	case copyLinked:
+		atomic.AddInt64(&s.Linked, 1)
+	case copyCopied:
+		atomic.AddInt64(&s.Copied, 1)
+		atomic.AddInt64(&s.FullsizeBytes, n)
+	}
+}
+
+// Generate creates or updates gallery as configured by args.
+func Generate(ctx context.Context, args Options) (*Result, error) {
+	begin := time.Now()
+	if err := args.applyGalleryFile(); err != nil {
+		return nil, err
+	}
+	if err := args.validate(); err != nil {
+		return nil, err
+	}
+	args.Cache = args.cacheFile()
+	timing := new(Timing)
+	// output directories may be nested in source directories, walk must
+	// skip them; they are compared as absolute paths, so that different
+	// spellings of the same path, like "./gallery/" and "gallery", match
+	var skipDirs []string
+	for _, dir := range []string{args.ThumbsDir, args.FullsizeDir} {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		skipDirs = append(skipDirs, abs)
+	}
+	gallery := defaultTemplate
+	templateSum := sha256.Sum256([]byte(DefaultTemplate + permalinkTemplateBody))
+	if args.Template != "" {
+		b, err := ioutil.ReadFile(args.Template)
+		if err != nil {
+			return nil, err
+		}
+		if gallery, err = template.New(filepath.Base(args.Template)).Parse(string(b)); err != nil {
+			return nil, err
+		}
+		templateSum = sha256.Sum256(append(b, permalinkTemplateBody...))
+	}
+	// bundle is written from temporary directories
+	outputDirs := []string{filepath.Dir(args.HTML), args.ThumbsDir, args.FullsizeDir}
+	if args.Bundle != "" {
+		outputDirs = nil
+	}
+	if args.Safe {
+		if err := checkOutputDirs(outputDirs); err != nil {
+			return nil, err
+		}
+	}
+	if args.Bundle != "" {
+		// next to the bundle, rather than in system temporary directory,
+		// which is often in memory
+		dir, err := ioutil.TempDir(filepath.Dir(args.Bundle), "photo-gallery-bundle-")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+		// bundle may be written into a source directory
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		skipDirs = append(skipDirs, abs)
+		if args, err = args.bundleLayout(dir); err != nil {
+			return nil, err
+		}
+	}
+	modes := fileModes{Dir: args.DirMode, File: args.FileMode}
+	if err := modes.mkdirAll(args.ThumbsDir); err != nil {
+		return nil, err
+	}
+	if err := modes.mkdirAll(args.FullsizeDir); err != nil {
+		return nil, err
+	}
+	if err := markOutputDirs(outputDirs, modes); err != nil {
+		return nil, err
+	}
+	thumbOpts, mediumOpts, err := args.thumbOptions()
+	if err != nil {
+		return nil, err
+	}
+	copyOpts := copyOptions{Verify: args.VerifyLinks, NoLink: args.Copy}
+	page := &galleryCache{Name: "Gallery", HashFunc: args.Hash, RelativeSources: true}
+	if page.HashFunc == "" {
+		page.HashFunc = HashFNV
+		if args.Phash {
+			page.HashFunc = HashPhash
+		}
+	}
+	if args.Cache != "" {
+		switch c, err := loadCache(args.Cache); {
+		case os.IsNotExist(err):
+		case err != nil:
+			return nil, err
+		default:
+			if c.HashFunc == "" { // caches created before HashFunc was introduced
+				c.HashFunc = HashFNV
+				if c.UsePhash {
+					c.HashFunc = HashPhash
+				}
+			}
+			if !c.RelativeSources { // caches created before sources were stored relative to source directory
+				c.relativizeSources(args.SrcDirs[0])
+			}
+			if c.HashFunc != page.HashFunc {
+				args.logf("metadata cache stored with %s hash, using it", c.HashFunc)
+			}
+			page = c
+		}
+	}
+	if page.hasher = hashers[page.HashFunc]; page.hasher == nil {
+		return nil, fmt.Errorf("unsupported hash function %q", page.HashFunc)
+	}
+	page.UsePhash = page.HashFunc == HashPhash
+	if args.PhashRotations && !page.hasher.Perceptual() {
+		return nil, fmt.Errorf("rotated duplicates can only be detected with %s hash", HashPhash)
+	}
+	if args.DedupeBrackets && !page.hasher.Perceptual() {
+		return nil, fmt.Errorf("bracketed frames can only be detected with %s hash", HashPhash)
+	}
+	page.DedupeBrackets = args.DedupeBrackets
+	if args.Clusters != "" && !page.hasher.Perceptual() {
+		return nil, fmt.Errorf("similar images can only be clustered with %s hash", HashPhash)
+	}
+	if args.Stacks && !page.hasher.Perceptual() {
+		return nil, fmt.Errorf("bursts can only be stacked with %s hash", HashPhash)
+	}
+	page.KeepSimilar = args.Clusters != "" || args.Stacks
+	if args.Name != "" {
+		page.Name = args.Name
+	}
+	if args.Footer != "" {
+		page.Footer = args.Footer
+	}
+	if args.Description != "" {
+		page.Description = args.Description
+	}
+	if args.URL != "" {
+		page.URL = args.URL
+	}
+	if args.TimeFrom != "" {
+		page.TimeFrom = args.TimeFrom
+	}
+	if page.TimeFrom == "" {
+		page.TimeFrom = TimeFromExifOrMtime
+	}
+	if args.CSS != "" {
+		b, err := ioutil.ReadFile(args.CSS)
+		if err != nil {
+			return nil, err
+		}
+		page.CustomCSS = template.CSS(b)
+	}
+	if args.MinRating != 0 {
+		// ratings may have changed since images were cached, drop those
+		// not matching, so walk re-adds them with fresh ratings; cached
+		// images with ratings lowered since are dropped after the walk,
+		// see lowRated
+		page.dropBelowRating(args.MinRating)
+	}
+	if h := hex.EncodeToString(templateSum[:]); page.TemplateHash != h {
+		if page.TemplateHash != "" {
+			args.logf("template changed since the previous run, html will be different")
+		}
+		page.TemplateHash = h
+	}
+	page.StylesheetHref = args.CSSHref
+	if page.BaseURL = args.BaseURL; page.BaseURL != "" && !strings.HasSuffix(page.BaseURL, "/") {
+		// base url is a directory, without trailing slash its last
+		// element would be replaced on resolving image paths
+		page.BaseURL += "/"
+	}
+	if args.Favicon != "" {
+		b, err := ioutil.ReadFile(args.Favicon)
+		if err != nil {
+			return nil, err
+		}
+		page.Favicon = dataURL(b, args.Favicon)
+	}
+	page.Permalinks = args.Permalinks
+	page.Eager = args.Eager
+	page.Initial = args.Initial
+	if page.GridMinWidth = args.GridMinWidth; page.GridMinWidth == 0 {
+		page.GridMinWidth = DefaultGridMinWidth
+	}
+	page.Spans = args.Spans
+	page.FeaturedApart = args.FeaturedApart
+	page.MarkNew = args.MarkNew
+	if page.Layout = args.Layout; page.Layout == "" {
+		page.Layout = LayoutGrid
+	}
+	page.Minify = args.Minify
+	page.NoIndex = args.NoIndex
+	if page.Schema = args.Schema; page.Schema && page.URL == "" {
+		return nil, errors.New("gallery url must be set to embed schema.org metadata")
+	}
+	if args.Password != "" {
+		if err := page.setPassword(args.Password); err != nil {
+			return nil, err
+		}
+	}
+	var tz *time.Location
+	if args.TZ != "" {
+		if tz, err = time.LoadLocation(args.TZ); err != nil {
+			return nil, err
+		}
+	}
+	var span timeRange
+	if args.Since != "" || args.Until != "" {
+		loc := time.Local
+		if tz != nil {
+			loc = tz
+		}
+		if span, err = parseTimeRange(args.Since, args.Until, loc); err != nil {
+			return nil, err
+		}
+		// cached images may be outside of the range, walk re-adds
+		// those within it
+		page.dropOutside(span)
+	}
+	ioJobs, cpuJobs := args.IOJobs, args.CPUJobs
+	if ioJobs == 0 {
+		ioJobs = runtime.GOMAXPROCS(0)
+	}
+	if cpuJobs == 0 {
+		cpuJobs = runtime.GOMAXPROCS(0)
+	}
+	stats := new(Stats)
+	// with Options.Deterministic, images are added after all are processed,
+	// so that the order workers finish in does not matter
+	type pendingImage struct {
+		path string
+		img  Image
+	}
+	var pending []pendingImage
+	var pendingMu sync.Mutex
+	// markers holds images with HiddenSuffix and FeaturedSuffix markers
+	// state of all added sources, so that cached images follow markers
+	// created or removed since
+	markers := make(map[string]Image)
+	// lowRated holds sources skipped for their rating, so that cached images
+	// with ratings lowered since are dropped; guarded by markersMu too
+	lowRated := make(map[string]struct{})
+	var markersMu sync.Mutex
+	var added int64 // images added so far, to save cache every args.Checkpoint
+	skipDups := args.OnDuplicate == DuplicateWarn || args.OnDuplicate == DuplicateSkip
+	// skipDuplicate reports image p skipped as duplicate, as described by err
+	skipDuplicate := func(p string, err error) {
+		atomic.AddInt64(&stats.Duplicates, 1)
+		if args.OnDuplicate == DuplicateWarn {
+			args.event(EventSkipped, p, 0, "skipping %s: %v", p, err)
+		} else {
+			args.vevent(EventSkipped, p, 0, "skipping %s: %v", p, err)
+		}
+	}
+	// images with the same phash share file names, so with skipDups all but
+	// the first one are skipped before creating files, which could otherwise
+	// end up made from a skipped image source instead of the kept one;
+	// bracketed frames are let through for dropBrackets
+	claimDups := skipDups && page.hasher.Perceptual() && !args.DedupeBrackets
+	// claims holds the first image processed for each key
+	claims := make(map[string]Image)
+	var claimsMu sync.Mutex
+	// claim reports whether image from source p is the first one with its
+	// key, reporting it as skipped duplicate otherwise
+	claim := func(p string, img Image) bool {
+		claimsMu.Lock()
+		first, ok := claims[img.key()]
+		if !ok {
+			claims[img.key()] = img
+		}
+		claimsMu.Unlock()
+		if ok && first.Source != img.Source {
+			skipDuplicate(p, &duplicateError{reason: "duplicate (same phash)", of: first})
+			return false
+		}
+		return true
+	}
+	addImage := func(p string, img Image) error {
+		markersMu.Lock()
+		markers[img.Source] = img
+		markersMu.Unlock()
+		err := page.add(img)
+		var dup *sameContentError
+		if args.AllowDupNames && errors.As(err, &dup) {
+			atomic.AddInt64(&stats.Duplicates, 1)
+			args.vevent(EventSkipped, p, 0, "skipping %s: same content as %s", p, dup.source)
+			return nil
+		}
+		if skipDups && isDuplicate(err) {
+			skipDuplicate(p, err)
+			// files of a similar image are named differently from
+			// ones of the kept image, so they are not used by it
+			var similar *duplicateError
+			if errors.As(err, &similar) && similar.of.key() != img.key() {
+				for _, f := range img.files() {
+					err := os.Remove(filepath.Join(filepath.Dir(args.HTML), filepath.FromSlash(f)))
+					if err != nil && !os.IsNotExist(err) {
+						return err
+					}
+				}
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("adding %q: %w", p, err)
+		}
+		if args.Checkpoint > 0 {
+			if n := atomic.AddInt64(&added, 1); n%int64(args.Checkpoint) == 0 {
+				if err := page.checkpoint(args.Cache); err != nil {
+					return fmt.Errorf("saving cache checkpoint: %w", err)
+				}
+				if err := modes.chmod(args.Cache); err != nil {
+					return err
+				}
+				args.vevent(EventMessage, args.Cache, int(n), "cache saved after %d images", n)
+			}
+		}
+		return nil
+	}
+	// walk sends source files to ch, from where they are read by ioJobs
+	// workers that filter and hash them, to pass to cpuJobs workers
+	// creating output files over hashed
+	ch := make(chan string)
+	hashed := make(chan hashedImage)
+	group, ctx := errgroup.WithContext(ctx)
+	var hashing sync.WaitGroup
+	for i := 0; i < ioJobs; i++ {
+		hashing.Add(1)
+		group.Go(func() error {
+			defer hashing.Done()
+			for p := range ch {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				format, err := imageFormat(p)
+				if err != nil {
+					return err
+				}
+				if format == "" {
+					args.event(EventSkipped, p, 0, "skipping %s: file is empty or not an image", p)
+					atomic.AddInt64(&stats.NotImages, 1)
+					continue
+				}
+				// malformed metadata is not fatal, image itself may
+				// still be fine
+				meta, _ := readXMP(p)
+				if args.MinRating != 0 && meta.Rating < args.MinRating {
+					markersMu.Lock()
+					lowRated[sourceName(args.SrcDirs[0], p)] = struct{}{}
+					markersMu.Unlock()
+					continue
+				}
+				imgTime, err := imageTime(p, page.TimeFrom, tz, func(format string, v ...interface{}) {
+					args.vevent(EventMessage, p, 0, format, v...)
+				})
+				if err != nil {
+					return err
+				}
+				if !span.contains(imgTime) {
+					continue
+				}
+				start := time.Now()
+				sum, err := page.hasher.Hash(p)
+				if err != nil {
+					return err
+				}
+				timing.since(&timing.Hash, start)
+				if len(sum) < 8 {
+					return fmt.Errorf("%s hash of %q is too short", page.HashFunc, p)
+				}
+				details := Image{Source: sourceName(args.SrcDirs[0], p), Hash: idFromBytes(sum), Rating: meta.Rating}
+				if details.Hidden, err = hasMarker(p, HiddenSuffix); err != nil {
+					return err
+				}
+				if details.Featured, err = hasMarker(p, FeaturedSuffix); err != nil {
+					return err
+				}
+				if len(sum) > 8 {
+					details.Digest = hex.EncodeToString(sum)
+				}
+				if args.PhashRotations {
+					start := time.Now()
+					if details.rotated, err = rotatedPhashes(p); err != nil {
+						return err
+					}
+					timing.since(&timing.Hash, start)
+				}
+				details.Time = imgTime
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case hashed <- hashedImage{path: p, format: format, meta: meta, details: details}:
+				}
+			}
+			return nil
+		})
+	}
+	group.Go(func() error {
+		hashing.Wait()
+		close(hashed)
+		return nil
+	})
+	toCreate := hashed
+	if claimDups && args.Deterministic {
+		// the first image of ones sharing key is only known after all
+		// are hashed, then they are claimed in order of source paths
+		toCreate = make(chan hashedImage)
+		group.Go(func() error {
+			defer close(toCreate)
+			var all []hashedImage
+			for h := range hashed {
+				all = append(all, h)
+			}
+			sort.Slice(all, func(i, j int) bool { return all[i].path < all[j].path })
+			for _, h := range all {
+				if !claim(h.path, h.details) {
+					continue
+				}
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case toCreate <- h:
+				}
+			}
+			return nil
+		})
+	}
+	for i := 0; i < cpuJobs; i++ {
+		group.Go(func() error {
+			for h := range toCreate {
+				p, format, meta, details := h.path, h.format, h.meta, h.details
+				// format is trusted over extension, which may be
+				// missing with Options.Sniff
+				ext := filepath.Ext(p)
+				reencode := format != formatJPEG
+				if lower := strings.ToLower(ext); reencode || lower != ".jpg" && lower != ".jpeg" {
+					ext = ".jpg"
+				}
+				fullsizeDir, thumbsDir := args.FullsizeDir, args.ThumbsDir
+				if args.Shard {
+					fullsizeDir = filepath.Join(fullsizeDir, shardName(details.key()))
+					thumbsDir = filepath.Join(thumbsDir, shardName(details.key()))
+					if err := modes.mkdirAll(fullsizeDir); err != nil {
+						return err
+					}
+					if err := modes.mkdirAll(thumbsDir); err != nil {
+						return err
+					}
+				}
+				fullsizeImage := filepath.Join(fullsizeDir, details.key()+ext)
+				thumbnailFile := filepath.Join(thumbsDir, details.key()+".jpg")
+				details.Original = filepath.ToSlash(fullsizeImage)
+				details.Thumbnail = filepath.ToSlash(thumbnailFile)
+				if dir := filepath.Dir(args.HTML); dir != "" {
+					s, err := filepath.Rel(dir, fullsizeImage)
+					if err != nil {
+						return err
+					}
+					details.Original = filepath.ToSlash(s)
+					s, err = filepath.Rel(dir, thumbnailFile)
+					if err != nil {
+						return err
+					}
+					details.Thumbnail = filepath.ToSlash(s)
+				}
+				if claimDups && !args.Deterministic && !claim(p, details) {
+					continue
+				}
+				// orientation from XMP overrides EXIF one
+				thumbOpts, mediumOpts := thumbOpts, mediumOpts
+				thumbOpts.Orientation, mediumOpts.Orientation = meta.Orientation, meta.Orientation
+				focus, err := readFocus(p)
+				if err != nil {
+					return err
+				}
+				thumbOpts.Focus = focus
+				start := time.Now()
+				n, err := createThumbnail(ctx, thumbOpts, thumbnailFile, p)
+				if err != nil {
+					return err
+				}
+				if n > 0 {
+					if err := modes.chmod(thumbnailFile); err != nil {
+						return err
+					}
+				}
+				stats.addThumbnail(n)
+				if args.MediumMaxDim > 0 {
+					w, h, err := imageSize(p)
+					if err != nil {
+						return err
+					}
+					if w > args.MediumMaxDim || h > args.MediumMaxDim {
+						mediumFile := filepath.Join(thumbsDir, details.key()+"-medium.jpg")
+						n, err := createThumbnail(ctx, mediumOpts, mediumFile, p)
+						if err != nil {
+							return err
+						}
+						if n > 0 {
+							if err := modes.chmod(mediumFile); err != nil {
+								return err
+							}
+						}
+						stats.addThumbnail(n)
+						details.Medium = filepath.ToSlash(mediumFile)
+						if dir := filepath.Dir(args.HTML); dir != "" {
+							s, err := filepath.Rel(dir, mediumFile)
+							if err != nil {
+								return err
+							}
+							details.Medium = filepath.ToSlash(s)
+						}
+					}
+				}
+				timing.since(&timing.Thumbnails, start)
+				start = time.Now()
+				if reencode || args.reorient(p, meta.Orientation) {
+					if n, err = convertToJPEG(ctx, fullsizeImage, p, meta.Orientation, thumbOpts.Background, args.SRGB); err != nil {
+						return err
+					}
+					if n > 0 {
+						if err := modes.chmod(fullsizeImage); err != nil {
+							return err
+						}
+						stats.addFullsize(copyCopied, n)
+					}
+				} else {
+					mode, n, err := linkOrCopy(ctx, copyOpts, fullsizeImage, p)
+					if err != nil {
+						return err
+					}
+					if mode == copyCopied {
+						if err := modes.chmod(fullsizeImage); err != nil {
+							return err
+						}
+					}
+					stats.addFullsize(mode, n)
+				}
+				timing.since(&timing.Fullsize, start)
+				// TODO: maybe move size check into thumbnail generation?
+				// Note that square thumbnails are never reported as
+				// portrait, so they all take a single grid cell.
+				if details.Width, details.Height, err = imageSize(thumbnailFile); err != nil {
+					return err
+				}
+				details.Portrait = details.Height > details.Width
+				// keywords from XMP take precedence over IPTC ones
+				if details.Tags = meta.Keywords; len(details.Tags) == 0 && !reencode {
+					// malformed metadata is not fatal, image itself may
+					// still be fine
+					details.Tags, _ = iptcKeywords(p)
+				}
+				details.Title = meta.Title
+				details.Camera, details.Exposure = cameraInfo(p)
+				if format == formatGIF {
+					if details.Animated, err = isAnimated(p); err != nil {
+						return err
+					}
+				}
+				if args.DedupeBrackets {
+					details.ExposureBias = exposureBias(p)
+				}
+				if args.Deterministic {
+					pendingMu.Lock()
+					pending = append(pending, pendingImage{path: p, img: details})
+					pendingMu.Unlock()
+					continue
+				}
+				if err := addImage(p, details); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	group.Go(func() error {
+		defer timing.since(&timing.Walk, time.Now())
+		defer close(ch)
+		ticker := time.NewTicker(2 * time.Second)
+		defer ticker.Stop()
+		var n int
+		var root string // source directory being walked
+		ignore := make(ignoreRules)
+		walkFunc := func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				abs, err := filepath.Abs(p)
+				if err != nil {
+					return err
+				}
+				for _, dir := range skipDirs {
+					if abs == dir {
+						return filepath.SkipDir
+					}
+				}
+			}
+			if p = filepath.Clean(p); p != root && ignore.match(root, p) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if info.IsDir() {
+				if skip, err := ignore.enter(p); err != nil {
+					return err
+				} else if skip {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			ext := strings.ToLower(filepath.Ext(p))
+			if _, ok := sourceExts[ext]; !ok {
+				if _, raw := rawExts[ext]; raw || !args.Sniff {
+					return nil
+				}
+				if format, err := imageFormat(p); err != nil {
+					return err
+				} else if format == "" {
+					return nil
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case ch <- p:
+				n++
+			}
+			select {
+			case <-ticker.C:
+				args.event(EventProgress, "", n, "processed %d images", n)
+			default:
+			}
+			return nil
+		}
+		for _, dir := range args.SrcDirs {
+			root = filepath.Clean(dir)
+			if err := filepath.Walk(dir, walkFunc); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].path < pending[j].path })
+	for _, p := range pending {
+		if err := addImage(p.path, p.img); err != nil {
+			return nil, err
+		}
+	}
+	for i, img := range page.Images {
+		if m, ok := markers[img.Source]; ok {
+			page.Images[i].Hidden, page.Images[i].Featured = m.Hidden, m.Featured
+			page.Images[i].Rating = m.Rating
+		}
+	}
+	if n := page.dropSources(lowRated); n != 0 {
+		args.event(EventOmitted, "", n, "%d cached images dropped as their rating is now below %d", n, args.MinRating)
+	}
+	if len(page.Images) == 0 {
+		return nil, errors.New("no images found")
+	}
+	page.sortByTime()
+	if args.DedupeBrackets {
+		dropped := page.dropBrackets()
+		// frames with the same phash share output files
+		used := make(map[string]struct{}, 2*len(page.Images))
+		for _, img := range page.Images {
+			for _, p := range img.files() {
+				used[p] = struct{}{}
+			}
+		}
+		root := filepath.Dir(args.HTML)
+		for _, img := range dropped {
+			for _, p := range img.files() {
+				if _, ok := used[p]; ok {
+					continue
+				}
+				used[p] = struct{}{}
+				if err := os.Remove(filepath.Join(root, filepath.FromSlash(p))); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if len(dropped) != 0 {
+			args.event(EventOmitted, "", len(dropped), "%d bracketed frames omitted", len(dropped))
+		}
+	}
+	if args.MaxOutputBytes > 0 {
+		n, err := trimToSize(page, filepath.Dir(args.HTML), args.MaxOutputBytes)
+		if err != nil {
+			return nil, err
+		}
+		if n != 0 {
+			args.event(EventOmitted, "", n, "%d oldest images omitted to fit output size limit", n)
+		}
+		if len(page.Images) == 0 {
+			return nil, errors.New("no images fit output size limit")
+		}
+	}
+	if args.IDScheme == IDSchemeSequential {
+		// number images from the oldest one, so adding newer images
+		// keeps existing ids
+		for i := range page.Images {
+			page.Images[i].id = strconv.Itoa(len(page.Images) - i)
+		}
+	}
+	// hidden images keep their files, but html is rendered as if they
+	// were not there
+	all := page.Images
+	page.Images = visibleImages(all)
+	if len(page.Images) == 0 {
+		return nil, errors.New("no visible images, all of them are hidden")
+	}
+	if page.MarkNew && page.n >= len(all) {
+		// on the first run every image is new, badges would be just noise
+		page.MarkNew = false
+	}
+	if n := len(all) - len(page.Images); n != 0 {
+		args.event(EventOmitted, "", n, "%d hidden images left out of html", n)
+	}
+	page.setTimeRange()
+	page.setTags()
+	if page.Stacks = args.Stacks; page.Stacks {
+		page.setStacks()
+	}
+	page.setGrid()
+	var stamp string
+	if args.Stamp {
+		stamp = fmt.Sprintf("generated by photo-gallery %s at %s", version(), time.Now().UTC().Format(time.RFC3339))
+	}
+	start := time.Now()
+	if err := renderFile(gallery, args.HTML, page, page.Minify, stamp); err != nil {
+		return nil, err
+	}
+	if err := modes.chmod(args.HTML); err != nil {
+		return nil, err
+	}
+	if args.Permalinks {
+		if err := writePermalinks(page, filepath.Base(args.HTML), filepath.Join(filepath.Dir(args.HTML), PermalinkDir), modes); err != nil {
+			return nil, err
+		}
+	}
+	timing.since(&timing.Render, start)
+	page.Images = all
+	// cache is saved before optional extras, so failing to write any of
+	// them does not lose metadata of images already processed
+	if args.Cache != "" {
+		if err := saveCache(page, args.Cache); err != nil {
+			return nil, err
+		}
+		if err := modes.chmod(args.Cache); err != nil {
+			return nil, err
+		}
+	}
+	if args.ContactSheet != "" {
+		thumbs := make([]string, len(page.Images))
+		for i, img := range page.Images {
+			thumbs[i] = filepath.Join(filepath.Dir(args.HTML), filepath.FromSlash(img.Thumbnail))
+		}
+		names, err := writeContactSheets(args.ContactSheet, thumbs, args.ContactCols)
+		if err != nil {
+			return nil, fmt.Errorf("writing contact sheet: %w", err)
+		}
+		for _, name := range names {
+			if err := modes.chmod(name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if args.Checksums != "" {
+		if err := writeChecksums(args.Checksums, filepath.Dir(args.HTML), page.Images); err != nil {
+			return nil, fmt.Errorf("writing checksums: %w", err)
+		}
+		if err := modes.chmod(args.Checksums); err != nil {
+			return nil, err
+		}
+	}
+	if args.Clusters != "" {
+		clusters := similarClusters(page.Images)
+		if err := writeClusters(args.Clusters, clusters); err != nil {
+			return nil, fmt.Errorf("writing clusters: %w", err)
+		}
+		if err := modes.chmod(args.Clusters); err != nil {
+			return nil, err
+		}
+		args.event(EventMessage, args.Clusters, len(clusters), "%d clusters of similar images found", len(clusters))
+	}
+	if args.Bundle != "" {
+		if err := writeBundle(args.Bundle, filepath.Dir(args.HTML)); err != nil {
+			return nil, fmt.Errorf("writing bundle: %w", err)
+		}
+		if err := modes.chmod(args.Bundle); err != nil {
+			return nil, err
+		}
+	}
+	timing.since(&timing.Total, begin)
+	res := &Result{Added: page.n, Images: make([]Image, len(page.Images)), Stats: *stats, Timing: *timing}
+	copy(res.Images, page.Images)
+	return res, nil
+}
+
+// visibleImages returns images that are not Hidden
+func visibleImages(images []Image) []Image {
+	out := make([]Image, 0, len(images))
+	for _, img := range images {
+		if !img.Hidden {
+			out = append(out, img)
+		}
+	}
+	return out
+}
+
+// hashedImage is a source image passed from workers hashing it to ones
+// creating its output files
+type hashedImage struct {
+	path    string  // source file
+	format  string  // one of format constants, see imageFormat
+	meta    xmpMeta // metadata from XMP packet and sidecar
+	details Image   // image with Source, Hash, Time and Rating set
+}
+
+// trimToSize keeps the longest prefix of page images with total size of their
+// thumbnails and full size images not exceeding max bytes, removing files of
+// the rest. Image paths are relative to root. It returns number of removed
+// images.
+func trimToSize(page *galleryCache, root string, max int64) (int, error) {
+	var total int64
+	for i, img := range page.Images {
+		for _, p := range img.files() {
+			fi, err := os.Stat(filepath.Join(root, filepath.FromSlash(p)))
+			if err != nil {
+				return 0, err
+			}
+			total += fi.Size()
+		}
+		if total <= max {
+			continue
+		}
+		for _, img := range page.Images[i:] {
+			for _, p := range img.files() {
+				if err := os.Remove(filepath.Join(root, filepath.FromSlash(p))); err != nil {
+					return 0, err
+				}
+			}
+		}
+		n := len(page.Images) - i
+		page.Images = page.Images[:i]
+		return n, nil
+	}
+	return 0, nil
+}
+
+// timeRange is a range of image times, zero bounds are open
+type timeRange struct {
+	since time.Time // inclusive
+	until time.Time // exclusive
+}
+
+// contains reports whether t is within the range
+func (r timeRange) contains(t time.Time) bool {
+	return (r.since.IsZero() || !t.Before(r.since)) && (r.until.IsZero() || t.Before(r.until))
+}
+
+// parseTimeRange returns range of image times with inclusive bounds since and
+// until, each either empty, RFC3339 time or a date in 2006-01-02 format
+// interpreted in loc. Date until includes the whole day.
+func parseTimeRange(since, until string, loc *time.Location) (timeRange, error) {
+	var r timeRange
+	parse := func(s string) (t time.Time, date bool, err error) {
+		if t, err := time.Parse(time.RFC3339, s); err == nil {
+			return t, false, nil
+		}
+		if t, err := time.ParseInLocation("2006-01-02", s, loc); err == nil {
+			return t, true, nil
+		}
+		return time.Time{}, false, fmt.Errorf("invalid time %q, must be in RFC3339 or 2006-01-02 format", s)
+	}
+	if since != "" {
+		t, _, err := parse(since)
+		if err != nil {
+			return r, err
+		}
+		r.since = t
+	}
+	if until != "" {
+		t, date, err := parse(until)
+		if err != nil {
+			return r, err
+		}
+		if date {
+			r.until = t.AddDate(0, 0, 1)
+		} else {
+			r.until = t.Add(time.Nanosecond)
+		}
+	}
+	if !r.since.IsZero() && !r.until.IsZero() && !r.since.Before(r.until) {
+		return r, errors.New("since time must not be after until time")
+	}
+	return r, nil
+}
+
+// dataURL returns data url embedding file content b; media type is guessed
+// from file name extension, or from content if extension is unknown
+func dataURL(b []byte, name string) template.URL {
+	typ := mime.TypeByExtension(filepath.Ext(name))
+	if typ == "" && strings.EqualFold(filepath.Ext(name), ".ico") { // not in builtin mime table
+		typ = "image/x-icon"
+	}
+	if typ == "" {
+		typ = http.DetectContentType(b)
+	}
+	return template.URL("data:" + typ + ";base64," + base64.StdEncoding.EncodeToString(b))
+}
+
+// renderFile executes template with given data and writes result to the file,
+// minifying it with minifyHTML if minify is true. Non-empty stamp is appended
+// as html comment, after minification so that it is kept.
+func renderFile(t *template.Template, name string, data interface{}, minify bool, stamp string) error {
+	buf := new(bytes.Buffer)
+	if err := t.Execute(buf, data); err != nil {
+		return err
+	}
+	b := buf.Bytes()
+	if minify {
+		b = minifyHTML(b)
+	}
+	if stamp != "" {
+		b = append(b, "<!-- "+stamp+" -->\n"...)
+	}
+	return ioutil.WriteFile(name, b, 0666)
+}
+
+// modulePath is a path of module providing this package
+const modulePath = "github.com/artyom/photo-gallery"
+
+// version returns version of this module the program is built with
+func version() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if info.Main.Path == modulePath {
+		return info.Main.Version
+	}
+	for _, m := range info.Deps {
+		if m.Path == modulePath {
+			return m.Version
+		}
+	}
+	return "unknown"
+}
+
+// DefaultSharpen is a default sigma of thumbnails sharpening, see
+// Options.Sharpen
+const DefaultSharpen = 0.5
+
+// DefaultMaxDestPixels is a default maximum number of pixels of created
+// thumbnails and medium size images, see Options.MaxDestPixels
+const DefaultMaxDestPixels = 1 << 26
+
+// DefaultGridMinWidth is a default minimum width of grid columns in pixels
+const DefaultGridMinWidth = 300
+
+// PermalinkDir is a name of directory next to html file holding per-image
+// pages
+const PermalinkDir = "p"
+
+// permalinkPage is a data passed to permalinkTemplate
+type permalinkPage struct {
+	Gallery    *galleryCache
+	Image      *Image
+	Prev, Next *Image // newer and older images, may be nil
+	Index      string // gallery html file name
+}
+
+// ImageURL returns url of image file s relative to permalink page
+func (p permalinkPage) ImageURL(s string) string {
+	if p.Gallery.BaseURL != "" {
+		return p.Gallery.ImageURL(s)
+	}
+	return "../" + s
+}
+
+// writePermalinks writes per-image html pages into dir
+func writePermalinks(page *galleryCache, index, dir string, modes fileModes) error {
+	if err := modes.mkdirAll(dir); err != nil {
+		return err
+	}
+	for i := range page.Images {
+		p := permalinkPage{Gallery: page, Image: &page.Images[i], Index: index}
+		if i > 0 {
+			p.Prev = &page.Images[i-1]
+		}
+		if i < len(page.Images)-1 {
+			p.Next = &page.Images[i+1]
+		}
+		name := filepath.Join(dir, p.Image.ID()+".html")
+		if err := renderFile(permalinkTemplate, name, p, page.Minify, ""); err != nil {
+			return err
+		}
+		if err := modes.chmod(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// contactCell is a size of a square cell holding single thumbnail on a
+// contact sheet
+const contactCell = 200
+
+const (
+	// maxContactSide is the largest width or height of a contact sheet
+	// image/jpeg can encode
+	maxContactSide = 1<<16 - 1
+	// maxContactPixels limits area of a single contact sheet, so memory
+	// needed to compose it stays reasonable
+	maxContactPixels = 1 << 26
+	// maxContactCols is the largest number of columns of a contact sheet
+	maxContactCols = maxContactSide / contactCell
+)
+
+// contactSheetNames returns names of contact sheet files written for n images
+// on a contact sheet with cols columns. Contact sheet exceeding size limits is
+// split into several files: the first one is named after name, the following
+// ones get "-2", "-3" and so on added before the extension.
+func contactSheetNames(name string, n, cols int) []string {
+	perSheet := contactRows(cols) * cols
+	out := []string{name}
+	ext := filepath.Ext(name)
+	for i := 2; (i-1)*perSheet < n; i++ {
+		out = append(out, strings.TrimSuffix(name, ext)+"-"+strconv.Itoa(i)+ext)
+	}
+	return out
+}
+
+// contactRows returns maximum number of rows of a single contact sheet with
+// cols columns
+func contactRows(cols int) int {
+	rows := maxContactPixels / (cols * contactCell * contactCell)
+	if rows > maxContactSide/contactCell {
+		rows = maxContactSide / contactCell
+	}
+	if rows < 1 {
+		rows = 1
+	}
+	return rows
+}
+
+// writeContactSheets composes thumbnail files into a grid with the given
+// number of columns and saves it as one or more jpeg files named as described
+// by contactSheetNames. It returns names of written files.
+func writeContactSheets(name string, thumbs []string, cols int) ([]string, error) {
+	names := contactSheetNames(name, len(thumbs), cols)
+	perSheet := contactRows(cols) * cols
+	for i, name := range names {
+		chunk := thumbs[i*perSheet:]
+		if len(chunk) > perSheet {
+			chunk = chunk[:perSheet]
+		}
+		if err := writeContactSheet(name, chunk, cols); err != nil {
+			return nil, err
+		}
+	}
+	return names, nil
+}
+
+// writeContactSheet composes thumbnail files into a grid with the given number
+// of columns and saves it as jpeg file
+func writeContactSheet(name string, thumbs []string, cols int) error {
+	const pad = 4
+	rows := (len(thumbs) + cols - 1) / cols
+	if rows < 1 {
+		rows = 1
+	}
+	sheet := imaging.New(cols*contactCell, rows*contactCell, color.White)
+	for i, p := range thumbs {
+		img, err := imaging.Open(p)
+		if err != nil {
+			return err
+		}
+		img = imaging.Fit(img, contactCell-2*pad, contactCell-2*pad, imaging.Linear)
+		// center thumbnail in its cell; draw.Draw is used instead of
+		// imaging.Paste, as the latter copies the whole sheet on each call
+		b := img.Bounds()
+		pt := image.Pt((i%cols)*contactCell+(contactCell-b.Dx())/2, (i/cols)*contactCell+(contactCell-b.Dy())/2)
+		draw.Draw(sheet, b.Sub(b.Min).Add(pt), img, b.Min, draw.Src)
+	}
+	return imaging.Save(sheet, name, imaging.JPEGQuality(90))
+}
+
+// sourceName returns path of source file p relative to base directory,
+// slash-separated; it is used as Image.Source. Files from other source
+// directories get names starting with "../". If p cannot be made relative to
+// base, its absolute path is returned.
+func sourceName(base, p string) string {
+	if abs, err := filepath.Abs(p); err == nil {
+		p = abs
+	}
+	if abs, err := filepath.Abs(base); err == nil {
+		base = abs
+	}
+	if rel, err := filepath.Rel(base, p); err == nil {
+		p = rel
+	}
+	return filepath.ToSlash(p)
+}
+
+// shardName returns name of subdirectory to store file with given key when
+// output is sharded: first two characters of the key
+func shardName(key string) string {
+	if len(key) < 2 {
+		return "0" + key
+	}
+	return key[:2]
+}
+
+// sourceExts maps supported source file extensions to whether full size copies
+// of such images have to be converted to jpeg for browsers to display them
+var sourceExts = map[string]bool{
+	".jpg":  false,
+	".jpeg": false,
+	".jpe":  false,
+	".tif":  true,
+	".tiff": true,
+	".gif":  true,
+}
+
+// rawExts are extensions of camera raw files, which are skipped even with
+// Options.Sniff: most of them start with TIFF signature, but their image data
+// cannot be decoded as TIFF
+var rawExts = map[string]struct{}{
+	".3fr": {}, ".arw": {}, ".cr2": {}, ".crw": {}, ".dcr": {}, ".dng": {},
+	".erf": {}, ".iiq": {}, ".kdc": {}, ".mef": {}, ".mos": {}, ".mrw": {},
+	".nef": {}, ".nrw": {}, ".orf": {}, ".pef": {}, ".raf": {}, ".rw2": {},
+	".rwl": {}, ".sr2": {}, ".srf": {}, ".srw": {}, ".x3f": {},
+}
+
+// Thumbnail layouts, see Options.Layout
+const (
+	LayoutGrid      = "grid"      // grid of equal cells, portrait images span two rows
+	LayoutMasonry   = "masonry"   // columns of GridMinWidth width, images keep their aspect ratio
+	LayoutJustified = "justified" // rows of equal height, about GridMinWidth, filling page width
+)
+
+// Layouts lists all supported thumbnail layouts
+var Layouts = []string{LayoutGrid, LayoutMasonry, LayoutJustified}
+
+// Duplicate image policies, see Options.OnDuplicate
+const (
+	DuplicateError = "error" // generation fails on the first duplicate
+	DuplicateWarn  = "warn"  // duplicates are reported and skipped, the first added image is kept
+	DuplicateSkip  = "skip"  // like DuplicateWarn, but duplicates are only reported with Verbose
+)
+
+// DuplicatePolicies lists all supported duplicate image policies
+var DuplicatePolicies = []string{DuplicateError, DuplicateWarn, DuplicateSkip}
+
+// Image id schemes, see Options.IDScheme. Ids are used for anchors and
+// permalink page names only: thumbnails and full size images keep file names
+// derived from content hashes, as sequential ids of existing images change
+// when older images are added.
+const (
+	IDSchemeHash       = "hash"       // ids are derived from image content hash
+	IDSchemeSequential = "sequential" // images are numbered by time, starting from the oldest one
+)
+
+// IDSchemes lists all supported image id schemes
+var IDSchemes = []string{IDSchemeHash, IDSchemeSequential}
+
+// Image describes single gallery image
+type Image struct {
+	Portrait  bool      `json:",omitempty"` // whether image height is larger than width
+	Animated  bool      `json:",omitempty"` // whether source is an animated gif
+	Tags      []string  `json:",omitempty"` // XMP or IPTC keywords
+	Title     string    `json:",omitempty"` // XMP title
+	Camera    string    `json:",omitempty"` // EXIF camera and lens models
+	Exposure  string    `json:",omitempty"` // EXIF exposure settings, like "1/250 s, f/4, ISO 100, 50 mm"
+	Rating    int       `json:",omitempty"` // XMP rating, -1 for rejected images
+	Hidden    bool      `json:",omitempty"` // whether image is left out of html, see HiddenSuffix
+	Featured  bool      `json:",omitempty"` // whether image is shown in featured section, see FeaturedSuffix
+	Original  string    // full-sized image copy
+	Medium    string    `json:",omitempty"` // medium size image shown instead of full-sized one, see Options.MediumMaxDim
+	Thumbnail string    // thumbnail
+	Width     int       `json:",omitempty"` // thumbnail width in pixels
+	Height    int       `json:",omitempty"` // thumbnail height in pixels
+	Source    string    // source file name relative to the first of Options.SrcDirs, slash-separated
+	Hash      uint64    `json:",string"`
+	Digest    string    `json:",omitempty"` // hex-encoded hash if it is wider than 64 bits
+	Time      time.Time // either date from exif or mtime
+
+	// ExposureBias is EXIF exposure bias in EV, it is only read with
+	// Options.DedupeBrackets
+	ExposureBias float64 `json:",omitempty"`
+
+	// Stack holds the rest of a burst represented by this image, and
+	// StackOf is ID of the representing image for those; both are set by
+	// setStacks with Options.Stacks
+	Stack   []Image `json:"-"`
+	StackOf string  `json:"-"`
+
+	// New is set for images added to the gallery during this run, it is
+	// derived anew on each run and only shown with Options.MarkNew
+	New bool `json:"-"`
+
+	id      string   // id assigned by IDSchemeSequential, not persisted
+	rotated []uint64 // phashes of rotated image, see Options.PhashRotations
+}
+
+// key returns image content key used to detect duplicates and as a base name
+// of output files: hex-encoded Digest if set, or Hash otherwise
+func (d *Image) key() string {
+	if d.Digest != "" {
+		return d.Digest
+	}
+	return fmt.Sprintf("%x", d.Hash)
+}
+
+// idToBytes returns v as byte slice laid out in big-endian order
+func idToBytes(v uint64) []byte {
+	var b []byte
+	return append(b, byte(v>>56), byte(v>>48), byte(v>>40), byte(v>>32), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// TagsJSON returns image tags as JSON array, this is used by template scripts
+func (d *Image) TagsJSON() string {
+	if len(d.Tags) == 0 {
+		return "[]"
+	}
+	b, _ := json.Marshal(d.Tags)
+	return string(b)
+}
+
+// ID returns image identifier, it is used as an html anchor and a permalink
+// page name
+func (d *Image) ID() string {
+	if d.id != "" {
+		return d.id
+	}
+	if d.Digest != "" {
+		if b, err := hex.DecodeString(d.Digest); err == nil {
+			return base64.RawURLEncoding.EncodeToString(b)
+		}
+	}
+	return base64.RawURLEncoding.EncodeToString(idToBytes(d.Hash))
+}
+
+// files returns paths of all output files of an image
+func (d *Image) files() []string {
+	if d.Medium != "" {
+		return []string{d.Thumbnail, d.Medium, d.Original}
+	}
+	return []string{d.Thumbnail, d.Original}
+}
+
+// Display returns path of image shown in full view: Medium if it is set, or
+// Original otherwise
+func (d *Image) Display() string {
+	if d.Medium != "" {
+		return d.Medium
+	}
+	return d.Original
+}
+
+// Aspect returns thumbnail width to height ratio, or 1 if its size is unknown
+func (d *Image) Aspect() float64 {
+	if d.Width == 0 || d.Height == 0 {
+		return 1
+	}
+	return float64(d.Width) / float64(d.Height)
+}
+
+// Panorama reports whether thumbnail is at least twice as wide as it is high
+func (d *Image) Panorama() bool { return d.Aspect() >= 2 }
+
+// DownloadName returns name to save full size image copy under: base name of
+// the source file, with characters not allowed in file names on common
+// systems replaced and extension matching the copy
+func (d *Image) DownloadName() string {
+	name := path.Base(filepath.ToSlash(d.Source))
+	name = strings.TrimSuffix(name, path.Ext(name)) + path.Ext(d.Original)
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// Caption returns a line describing image for the full view: source file
+// name, time, camera and exposure settings, with missing ones left out
+func (d *Image) Caption() string {
+	var parts []string
+	if d.Source != "" {
+		parts = append(parts, path.Base(filepath.ToSlash(d.Source)))
+	}
+	if !d.Time.IsZero() {
+		parts = append(parts, d.Time.Format("2 January 2006 15:04"))
+	}
+	if d.Camera != "" {
+		parts = append(parts, d.Camera)
+	}
+	if d.Exposure != "" {
+		parts = append(parts, d.Exposure)
+	}
+	return strings.Join(parts, " · ")
+}
+
+// Permalink returns path to per-image page relative to gallery html file
+func (d *Image) Permalink() string {
+	return PermalinkDir + "/" + d.ID() + ".html"
+}
@@ -0,0 +1,258 @@
+package gallery
+
+import (
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+func TestContactSheetNames(t *testing.T) {
+	perSheet := contactRows(6) * 6
+	table := []struct {
+		n    int
+		want []string
+	}{
+		{0, []string{"sheet.jpg"}},
+		{1, []string{"sheet.jpg"}},
+		{perSheet, []string{"sheet.jpg"}},
+		{perSheet + 1, []string{"sheet.jpg", "sheet-2.jpg"}},
+		{3 * perSheet, []string{"sheet.jpg", "sheet-2.jpg", "sheet-3.jpg"}},
+	}
+	for _, tc := range table {
+		if got := contactSheetNames("sheet.jpg", tc.n, 6); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("contactSheetNames(%d images) = %q, want %q", tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestContactRows(t *testing.T) {
+	for _, cols := range []int{1, 6, 100, maxContactCols} {
+		rows := contactRows(cols)
+		if rows < 1 {
+			t.Fatalf("contactRows(%d) = %d", cols, rows)
+		}
+		w, h := cols*contactCell, rows*contactCell
+		if w > maxContactSide || h > maxContactSide {
+			t.Errorf("%d columns: %dx%d sheet is too large for jpeg", cols, w, h)
+		}
+		if w*h > maxContactPixels {
+			t.Errorf("%d columns: %dx%d sheet exceeds %d pixels", cols, w, h, maxContactPixels)
+		}
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	table := []struct {
+		name string
+		opts Options
+		ok   bool
+	}{
+		{"nested", Options{SrcDirs: []string{"/photos"}, HTML: "/a/b/index.html", ThumbsDir: "/a/b/t", FullsizeDir: "/a/b/o"}, true},
+		{"siblings", Options{SrcDirs: []string{"/photos"}, HTML: "/a/site/index.html", ThumbsDir: "/a/thumbs", FullsizeDir: "/a/full"}, true},
+		{"parent-relative", Options{SrcDirs: []string{"photos"}, HTML: "site/index.html", ThumbsDir: "../thumbs", FullsizeDir: "../../full"}, true},
+		{"relative to current directory", Options{SrcDirs: []string{"photos"}, HTML: "index.html", ThumbsDir: "t", FullsizeDir: "./o"}, true},
+		{"prefix sharing sibling", Options{SrcDirs: []string{"/photos"}, HTML: "/a/b/index.html", ThumbsDir: "/a/bc/t", FullsizeDir: "/a/bc/o"}, true},
+		{"absolute and relative", Options{SrcDirs: []string{"/photos"}, HTML: "/a/index.html", ThumbsDir: "t", FullsizeDir: "/a/o"}, false},
+		{"relative and absolute", Options{SrcDirs: []string{"/photos"}, HTML: "index.html", ThumbsDir: "t", FullsizeDir: "/a/o"}, false},
+		{"same output directories", Options{SrcDirs: []string{"/photos"}, HTML: "/a/index.html", ThumbsDir: "/a/t/", FullsizeDir: "/a/t"}, false},
+		{"thumbnails in source", Options{SrcDirs: []string{"/photos", "/a/t"}, HTML: "/a/index.html", ThumbsDir: "/a/./t", FullsizeDir: "/a/o"}, false},
+		{"no source", Options{HTML: "/a/index.html", ThumbsDir: "/a/t", FullsizeDir: "/a/o"}, false},
+		{"no html", Options{SrcDirs: []string{"/photos"}, ThumbsDir: "/a/t", FullsizeDir: "/a/o"}, false},
+		{"bundle inside", Options{SrcDirs: []string{"/photos"}, HTML: "/a/b/index.html", ThumbsDir: "/a/b/t", FullsizeDir: "/a/b/o", Bundle: "/a/b.zip"}, true},
+		{"bundle with prefix sharing sibling", Options{SrcDirs: []string{"/photos"}, HTML: "/a/b/index.html", ThumbsDir: "/a/bc/t", FullsizeDir: "/a/b/o", Bundle: "/a/b.zip"}, false},
+		{"bundle with parent", Options{SrcDirs: []string{"photos"}, HTML: "site/index.html", ThumbsDir: "site/t", FullsizeDir: "o", Bundle: "b.zip"}, false},
+	}
+	for _, tc := range table {
+		if err := tc.opts.validate(); (err == nil) != tc.ok {
+			t.Errorf("%s: unexpected validation result: %v", tc.name, err)
+		}
+	}
+}
+
+func TestInsideDir(t *testing.T) {
+	table := []struct {
+		dir, p string
+		want   bool
+	}{
+		{"/a/b", "/a/b/c", true},
+		{"/a/b", "/a/b/c/d", true},
+		{"/a/b", "/a/b", true},
+		{"/a/b/", "/a/b/c", true},
+		{"/a/b", "/a/bc", false},
+		{"/a/b", "/a/bc/d", false},
+		{"/a/b", "/a", false},
+		{"/a/b", "/a/c", false},
+		{"/a/b", "/a/b/../c", false},
+		{"/a/b", "/a/b/..c", true},
+		{"a", "a/b", true},
+		{"a", "./a/b", true},
+		{"a", "b", false},
+		{".", "b", true},
+		{".", "../b", false},
+		{"/a", "b", false},
+	}
+	for _, tc := range table {
+		if got := insideDir(tc.dir, tc.p); got != tc.want {
+			t.Errorf("insideDir(%q, %q) = %v, want %v", tc.dir, tc.p, got, tc.want)
+		}
+	}
+}
+
+func TestGenerateNestedOutput(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	table := []struct {
+		name          string
+		thumbs, fulls string
+	}{
+		{"clean", "src/gallery/thumbs", "src/gallery/full"},
+		{"trailing slash", "src/gallery/thumbs/", "src/gallery/full/"},
+		{"dot prefix", "./src/gallery/thumbs", "./src//gallery/./full"},
+		{"dot prefix and trailing slash", "./src/gallery/thumbs/", "./src/gallery/full/"},
+	}
+	for _, tc := range table {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := os.Chdir(t.TempDir()); err != nil {
+				t.Fatal(err)
+			}
+			const n = 3
+			writeTestImages(t, "src", n)
+			args := Options{
+				SrcDirs:     []string{"src"},
+				HTML:        "src/gallery/index.html",
+				ThumbsDir:   tc.thumbs,
+				FullsizeDir: tc.fulls,
+			}
+			// the second run finds files written by the first one in
+			// source directory, unless it skips them
+			for run := 1; run <= 2; run++ {
+				res, err := Generate(context.Background(), args)
+				if err != nil {
+					t.Fatalf("run %d: %v", run, err)
+				}
+				if len(res.Images) != n {
+					t.Fatalf("run %d: got %d images, want %d", run, len(res.Images), n)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkGenerate measures creating thumbnails and medium size images of
+// camera-sized photos with one and with GOMAXPROCS workers; each worker
+// decodes, resizes and encodes its own images
+func BenchmarkGenerate(b *testing.B) {
+	src := b.TempDir()
+	writeTestImagesSize(b, src, 8, 4000, 3000)
+	jobs := []int{1}
+	if n := runtime.GOMAXPROCS(0); n > 1 {
+		jobs = append(jobs, n)
+	}
+	for _, n := range jobs {
+		b.Run("jobs="+strconv.Itoa(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				out := filepath.Join(b.TempDir(), strconv.Itoa(i))
+				b.StartTimer()
+				_, err := Generate(context.Background(), Options{
+					SrcDirs:      []string{src},
+					HTML:         filepath.Join(out, "index.html"),
+					ThumbsDir:    filepath.Join(out, "t"),
+					FullsizeDir:  filepath.Join(out, "o"),
+					MediumMaxDim: 1600,
+					CPUJobs:      n,
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// writeTestImages writes n distinct small jpeg files into directory dir
+func writeTestImages(t testing.TB, dir string, n int) {
+	t.Helper()
+	writeTestImagesSize(t, dir, n, 64, 48)
+}
+
+// writeTestImagesSize writes n distinct w by h jpeg files into directory dir
+func writeTestImagesSize(t testing.TB, dir string, n, w, h int) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		img := image.NewRGBA(image.Rect(0, 0, w, h))
+		for x := 0; x < w; x++ {
+			for y := 0; y < h; y++ {
+				img.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 5), uint8(i*80 + x*y), 255})
+			}
+		}
+		f, err := os.Create(filepath.Join(dir, "img"+strconv.Itoa(i)+".jpg"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := jpeg.Encode(f, img, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestThumbOptionsSharpen(t *testing.T) {
+	table := []struct{ sharpen, want float64 }{
+		{0, DefaultSharpen},
+		{-1, -1},
+		{1.5, 1.5},
+	}
+	for _, tc := range table {
+		thumb, medium, err := (&Options{Sharpen: tc.sharpen}).thumbOptions()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if thumb.Sharpen != tc.want || medium.Sharpen != tc.want {
+			t.Errorf("Sharpen %v: got %v and %v for thumbnails and medium images, want %v",
+				tc.sharpen, thumb.Sharpen, medium.Sharpen, tc.want)
+		}
+	}
+}
+
+func TestReorient(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "rotated.jpg")
+	if err := ioutil.WriteFile(name, jpegWithOrientation(t, 4, 2, binary.BigEndian, 6), 0666); err != nil {
+		t.Fatal(err)
+	}
+	table := []struct {
+		orientOriginals bool
+		xmpOrientation  int
+		want            bool
+	}{
+		{false, 0, false},
+		{false, 6, false},
+		{false, 1, true},
+		{true, 0, true},
+		{true, 6, true},
+	}
+	for _, tc := range table {
+		a := &Options{OrientOriginals: tc.orientOriginals}
+		if got := a.reorient(name, tc.xmpOrientation); got != tc.want {
+			t.Errorf("OrientOriginals %v, XMP orientation %d: got %v, want %v",
+				tc.orientOriginals, tc.xmpOrientation, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package gallery
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// GalleryFile is a name of an optional JSON file in the first of source
+// directories holding gallery settings, so they can be kept along with images.
+// It is an object with these keys, all optional:
+//
+//	{
+//		"Name": "gallery name",
+//		"Footer": "footer text",
+//		"Description": "gallery description",
+//		"URL": "public url of html file",
+//		"BaseURL": "url to load images from, see Options.BaseURL"
+//	}
+//
+// Unknown keys are reported as errors. Values set in Options take precedence.
+const GalleryFile = "gallery.json"
+
+// galleryFile holds settings read from GalleryFile
+type galleryFile struct {
+	Name        string
+	Footer      string
+	Description string
+	URL         string
+	BaseURL     string
+}
+
+// readGalleryFile reads GalleryFile from directory dir. It returns zero value
+// without error if there is no such file.
+func readGalleryFile(dir string) (galleryFile, error) {
+	var f galleryFile
+	name := filepath.Join(dir, GalleryFile)
+	b, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return f, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return f, fmt.Errorf("parsing %s: %w", name, err)
+	}
+	return f, nil
+}
+
+// applyGalleryFile fills settings not set in a from GalleryFile in the first of
+// source directories, if there is one
+func (a *Options) applyGalleryFile() error {
+	if len(a.SrcDirs) == 0 {
+		return nil
+	}
+	f, err := readGalleryFile(a.SrcDirs[0])
+	if err != nil {
+		return err
+	}
+	if a.Name == "" {
+		a.Name = f.Name
+	}
+	if a.Footer == "" {
+		a.Footer = f.Footer
+	}
+	if a.Description == "" {
+		a.Description = f.Description
+	}
+	if a.URL == "" {
+		a.URL = f.URL
+	}
+	if a.BaseURL == "" {
+		a.BaseURL = f.BaseURL
+	}
+	return nil
+}
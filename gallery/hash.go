@@ -0,0 +1,82 @@
+package gallery
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"hash/fnv"
+	"io"
+	"os"
+)
+
+// Hasher computes image identifiers used to detect duplicates and to name
+// output files
+type Hasher interface {
+	// Hash returns identifier of an image file. Identifier is at least 8
+	// bytes long; 8 byte identifiers are stored as Image.Hash only, longer
+	// ones also as Image.Digest.
+	Hash(name string) ([]byte, error)
+	// Perceptual reports whether identifiers of visually similar images are
+	// close by Hamming distance, as opposed to exact content hashes.
+	// Perceptual identifiers must be exactly 8 bytes long.
+	Perceptual() bool
+}
+
+// Hash function names, see Options.Hash
+const (
+	HashFNV       = "fnv"          // 64 bit FNV-1a hash of file content
+	HashFNV128    = "fnv128"       // 128 bit FNV-1a hash of file content
+	HashPhash     = "phash"        // perceptual hash of image, slow
+	HashSHA256    = "sha256-trunc" // SHA-256 of file content truncated to 64 bits
+	HashSHA256128 = "sha256-128"   // SHA-256 of file content truncated to 128 bits
+)
+
+// HashFuncs lists all supported hash function names
+var HashFuncs = []string{HashFNV, HashFNV128, HashPhash, HashSHA256, HashSHA256128}
+
+// hashers maps hash function names to their implementations
+var hashers = map[string]Hasher{
+	HashFNV:       contentHasher{new: func() hash.Hash { return fnv.New64a() }, size: 8},
+	HashFNV128:    contentHasher{new: fnv.New128a, size: 16},
+	HashPhash:     perceptualHasher(imagePhash),
+	HashSHA256:    contentHasher{new: sha256.New, size: 8},
+	HashSHA256128: contentHasher{new: sha256.New, size: 16},
+}
+
+// contentHasher is a Hasher computing exact content hash, truncated to size
+// bytes
+type contentHasher struct {
+	new  func() hash.Hash
+	size int
+}
+
+func (h contentHasher) Hash(name string) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hh := h.new()
+	if _, err := io.Copy(hh, f); err != nil {
+		return nil, err
+	}
+	return hh.Sum(nil)[:h.size], nil
+}
+
+func (contentHasher) Perceptual() bool { return false }
+
+// perceptualHasher is a Hasher computing perceptual hash
+type perceptualHasher func(name string) (uint64, error)
+
+func (h perceptualHasher) Hash(name string) ([]byte, error) {
+	v, err := h(name)
+	if err != nil {
+		return nil, err
+	}
+	return idToBytes(v), nil
+}
+
+func (perceptualHasher) Perceptual() bool { return true }
+
+// idFromBytes returns first 8 bytes of b as big-endian uint64
+func idFromBytes(b []byte) uint64 { return binary.BigEndian.Uint64(b) }
@@ -0,0 +1,306 @@
+package gallery
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/disintegration/imaging"
+)
+
+// iccProfile is a matrix/TRC ICC profile, the kind used by RGB color spaces
+// like Adobe RGB and Display P3. It maps device colors to linear values with
+// per-channel tone curves, and those to XYZ with D50 white point by matrix.
+type iccProfile struct {
+	matrix [3][3]float64   // rows are X, Y, Z; columns are r, g, b
+	trc    [3][256]float64 // linear value of each 8-bit channel value
+}
+
+// readICC returns color profile embedded into jpeg file name. It returns nil
+// without error if file is not a jpeg or has no profile embedded.
+func readICC(name string) (*iccProfile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b, err := jpegICC(bufio.NewReader(f))
+	if err != nil || b == nil {
+		return nil, err
+	}
+	return parseICC(b)
+}
+
+// jpegICC returns ICC profile data stored in APP2 segments of jpeg read from
+// r, profiles larger than a segment are split over several ones. It stops on
+// the start of image data, as metadata segments precede it.
+func jpegICC(r *bufio.Reader) ([]byte, error) {
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi != [2]byte{0xff, 0xd8} {
+		return nil, nil
+	}
+	const prefix = "ICC_PROFILE\x00"
+	chunks := make(map[byte][]byte)
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if c != 0xff {
+			return nil, errors.New("malformed jpeg segment marker")
+		}
+		marker, err := r.ReadByte()
+		for err == nil && marker == 0xff { // fill bytes
+			marker, err = r.ReadByte()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if marker == 0xda || marker == 0xd9 { // start of scan, end of image
+			break
+		}
+		var size uint16
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return nil, err
+		}
+		if size < 2 {
+			return nil, errors.New("malformed jpeg segment size")
+		}
+		if marker != 0xe2 {
+			if _, err := r.Discard(int(size) - 2); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		b := make([]byte, size-2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		if len(b) > len(prefix)+2 && string(b[:len(prefix)]) == prefix {
+			chunks[b[len(prefix)]] = b[len(prefix)+2:]
+		}
+	}
+	if len(chunks) == 0 {
+		return nil, nil
+	}
+	seqs := make([]int, 0, len(chunks))
+	for k := range chunks {
+		seqs = append(seqs, int(k))
+	}
+	sort.Ints(seqs)
+	var out []byte
+	for _, k := range seqs {
+		out = append(out, chunks[byte(k)]...)
+	}
+	return out, nil
+}
+
+// parseICC parses ICC profile, it only supports RGB matrix/TRC profiles
+func parseICC(b []byte) (*iccProfile, error) {
+	if len(b) < 132 || string(b[36:40]) != "acsp" {
+		return nil, errors.New("malformed color profile")
+	}
+	if string(b[16:20]) != "RGB " {
+		return nil, fmt.Errorf("unsupported color profile space %q", b[16:20])
+	}
+	tags := make(map[string][]byte)
+	n := int(binary.BigEndian.Uint32(b[128:]))
+	for i := 0; i < n; i++ {
+		off := 132 + 12*i
+		if off+12 > len(b) {
+			return nil, errors.New("malformed color profile tag table")
+		}
+		sig := string(b[off : off+4])
+		start, size := binary.BigEndian.Uint32(b[off+4:]), binary.BigEndian.Uint32(b[off+8:])
+		if uint64(start)+uint64(size) > uint64(len(b)) {
+			return nil, fmt.Errorf("color profile tag %q is out of bounds", sig)
+		}
+		tags[sig] = b[start : start+size]
+	}
+	p := new(iccProfile)
+	for c, sig := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		t := tags[sig]
+		if len(t) < 20 || string(t[:4]) != "XYZ " {
+			return nil, fmt.Errorf("color profile has no %q tag, only matrix/TRC profiles are supported", sig)
+		}
+		for i := 0; i < 3; i++ {
+			p.matrix[i][c] = s15Fixed16(t[8+4*i:])
+		}
+	}
+	for c, sig := range []string{"rTRC", "gTRC", "bTRC"} {
+		curve, err := parseCurve(tags[sig])
+		if err != nil {
+			return nil, fmt.Errorf("color profile %q tag: %w", sig, err)
+		}
+		for v := range p.trc[c] {
+			p.trc[c][v] = curve(float64(v) / 255)
+		}
+	}
+	return p, nil
+}
+
+// parseCurve parses ICC curv or para tone curve into a function mapping
+// device values to linear ones, both in 0..1 range
+func parseCurve(t []byte) (func(float64) float64, error) {
+	if len(t) < 12 {
+		return nil, errors.New("missing or truncated curve")
+	}
+	switch string(t[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(t[8:]))
+		if len(t) < 12+2*n {
+			return nil, errors.New("truncated curve")
+		}
+		switch n {
+		case 0:
+			return func(x float64) float64 { return x }, nil
+		case 1:
+			g := float64(binary.BigEndian.Uint16(t[12:])) / 256
+			return func(x float64) float64 { return math.Pow(x, g) }, nil
+		}
+		table := make([]float64, n)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(t[12+2*i:])) / 65535
+		}
+		return func(x float64) float64 {
+			pos := x * float64(n-1)
+			i := int(pos)
+			if i >= n-1 {
+				return table[n-1]
+			}
+			return table[i] + (table[i+1]-table[i])*(pos-float64(i))
+		}, nil
+	case "para":
+		// numbers of parameters of function types 0 to 4
+		counts := []int{1, 3, 4, 5, 7}
+		typ := int(binary.BigEndian.Uint16(t[8:]))
+		if typ >= len(counts) {
+			return nil, fmt.Errorf("unsupported parametric curve type %d", typ)
+		}
+		if len(t) < 12+4*counts[typ] {
+			return nil, errors.New("truncated parametric curve")
+		}
+		// g, a, b, c, d, e, f as named by the ICC specification
+		var v [7]float64
+		for i := 0; i < counts[typ]; i++ {
+			v[i] = s15Fixed16(t[12+4*i:])
+		}
+		g, a, b, c, d, e, f := v[0], v[1], v[2], v[3], v[4], v[5], v[6]
+		if (typ == 1 || typ == 2) && a == 0 {
+			return nil, fmt.Errorf("parametric curve type %d with zero slope", typ)
+		}
+		switch typ {
+		case 1:
+			d = -b / a
+		case 2:
+			d, e, f = -b/a, c, c
+			c = 0
+		case 0:
+			a, d = 1, math.Inf(-1)
+		}
+		return func(x float64) float64 {
+			if x >= d {
+				if y := a*x + b; y > 0 {
+					return math.Pow(y, g) + e
+				}
+				return e
+			}
+			return c*x + f
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported curve type %q", t[:4])
+}
+
+// s15Fixed16 decodes ICC signed 15.16 fixed point number
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// xyzToSRGB converts XYZ with D50 white point, as used by ICC profiles, to
+// linear sRGB; it includes Bradford adaptation to sRGB D65 white point
+var xyzToSRGB = [3][3]float64{
+	{3.1338561, -1.6168667, -0.4906146},
+	{-0.9787684, 1.9161415, 0.0334540},
+	{0.0719453, -0.2289914, 1.4052427},
+}
+
+// srgbGamma maps linear values quantized to 16 bits to 8-bit sRGB ones; finer
+// steps are needed in shadows, where sRGB ones are the smallest in linear terms
+var srgbGamma = func() (t [1 << 16]uint8) {
+	for i := range t {
+		v := float64(i) / float64(len(t)-1)
+		if v <= 0.0031308 {
+			v *= 12.92
+		} else {
+			v = 1.055*math.Pow(v, 1/2.4) - 0.055
+		}
+		t[i] = uint8(v*255 + 0.5)
+	}
+	return t
+}()
+
+// toSRGB returns copy of img with colors converted from profile p to sRGB
+func (p *iccProfile) toSRGB(img image.Image) image.Image {
+	var m [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				m[i][j] += xyzToSRGB[i][k] * p.matrix[k][j]
+			}
+		}
+	}
+	dst := imaging.Clone(img)
+	pix := dst.Pix
+	for i := 0; i+3 < len(pix); i += 4 {
+		r, g, b := p.trc[0][pix[i]], p.trc[1][pix[i+1]], p.trc[2][pix[i+2]]
+		for c := 0; c < 3; c++ {
+			v := m[c][0]*r + m[c][1]*g + m[c][2]*b
+			switch {
+			case v < 0:
+				v = 0
+			case v > 1:
+				v = 1
+			}
+			pix[i+c] = srgbGamma[int(v*float64(len(srgbGamma)-1)+0.5)]
+		}
+	}
+	return dst
+}
+
+// sRGB reports whether profile is close enough to sRGB for conversion to
+// make no visible difference
+func (p *iccProfile) sRGB() bool {
+	// sRGB primaries adapted to D50, as stored by sRGB profiles
+	srgb := [3][3]float64{
+		{0.4360747, 0.3850649, 0.1430804},
+		{0.2225045, 0.7168786, 0.0606169},
+		{0.0139322, 0.0971045, 0.7141733},
+	}
+	for i := range srgb {
+		for j := range srgb[i] {
+			if math.Abs(srgb[i][j]-p.matrix[i][j]) > 0.002 {
+				return false
+			}
+		}
+	}
+	for c := range p.trc {
+		for v, lin := range p.trc[c] {
+			x := float64(v) / 255
+			if x <= 0.04045 {
+				x /= 12.92
+			} else {
+				x = math.Pow((x+0.055)/1.055, 2.4)
+			}
+			if math.Abs(x-lin) > 0.004 {
+				return false
+			}
+		}
+	}
+	return true
+}
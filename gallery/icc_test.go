@@ -0,0 +1,295 @@
+package gallery
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestJpegICC(t *testing.T) {
+	profile := []byte("first chunk|second chunk|third chunk")
+	table := []struct {
+		name string
+		data []byte
+		want []byte
+	}{
+		{"single chunk", testJPEG(iccChunk(1, 1, profile)), profile},
+		{"chunks in order", testJPEG(iccChunk(1, 3, profile[:12]), iccChunk(2, 3, profile[12:25]), iccChunk(3, 3, profile[25:])), profile},
+		{"chunks out of order", testJPEG(iccChunk(3, 3, profile[25:]), iccChunk(1, 3, profile[:12]), iccChunk(2, 3, profile[12:25])), profile},
+		{"other segments between chunks", testJPEG(iccChunk(2, 2, profile[12:]), testSegment(0xe1, []byte("Exif\x00\x00")), iccChunk(1, 2, profile[:12])), profile},
+		{"no profile", testJPEG(testSegment(0xe0, []byte("JFIF\x00"))), nil},
+		{"other APP2 data", testJPEG(testSegment(0xe2, []byte("FPXR\x00stuff"))), nil},
+		{"not a jpeg", []byte("GIF89a"), nil},
+	}
+	for _, tc := range table {
+		got, err := jpegICC(bufio.NewReader(bytes.NewReader(tc.data)))
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !bytes.Equal(got, tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+	// segment size smaller than the size field itself
+	bad := []byte{0xff, 0xd8, 0xff, 0xe2, 0x00, 0x01}
+	if _, err := jpegICC(bufio.NewReader(bytes.NewReader(bad))); err == nil {
+		t.Error("malformed segment size: no error")
+	}
+}
+
+func TestParseICC(t *testing.T) {
+	good := testProfile(displayP3, srgbCurve())
+	if _, err := parseICC(good); err != nil {
+		t.Fatalf("valid profile: %v", err)
+	}
+	truncatedTable := append([]byte(nil), good[:132+12]...) // only the first of 6 tags
+	outOfBounds := append([]byte(nil), good...)
+	binary.BigEndian.PutUint32(outOfBounds[132+8:], uint32(len(good))) // size of the first tag
+	cmyk := append([]byte(nil), good...)
+	copy(cmyk[16:], "CMYK")
+	noMagic := append([]byte(nil), good...)
+	copy(noMagic[36:], "xxxx")
+	noMatrix := append([]byte(nil), good...)
+	copy(noMatrix[132:], "zzzz") // rename rXYZ tag
+	table := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"header only", good[:128]},
+		{"truncated tag table", truncatedTable},
+		{"tag out of bounds", outOfBounds},
+		{"not RGB", cmyk},
+		{"no signature", noMagic},
+		{"no matrix tag", noMatrix},
+		{"bad curve", testProfile(displayP3, []byte("curv"))},
+	}
+	for _, tc := range table {
+		if _, err := parseICC(tc.data); err == nil {
+			t.Errorf("%s: no error", tc.name)
+		}
+	}
+}
+
+func TestParseCurve(t *testing.T) {
+	type point struct{ x, y float64 }
+	table := []struct {
+		name   string
+		data   []byte
+		points []point
+	}{
+		{"curv identity", curvCurve(), []point{{0, 0}, {0.3, 0.3}, {1, 1}}},
+		{"curv gamma", curvCurve(512), []point{{0, 0}, {0.5, 0.25}, {1, 1}}},
+		{"curv table", curvCurve(0, 16384, 65535), []point{{0, 0}, {0.25, 0.125}, {0.75, 0.625}, {1, 1}}},
+		// y = x^g
+		{"para 0", paraCurve(0, 2), []point{{0, 0}, {0.5, 0.25}, {1, 1}}},
+		// y = (ax+b)^g for x >= -b/a, 0 otherwise
+		{"para 1", paraCurve(1, 2, 0.5, -0.25), []point{{0.25, 0}, {0.5, 0}, {1, 0.0625}}},
+		// y = (ax+b)^g + c for x >= -b/a, c otherwise
+		{"para 2", paraCurve(2, 2, 0.5, -0.25, 0.125), []point{{0.25, 0.125}, {1, 0.1875}}},
+		// y = (ax+b)^g for x >= d, cx otherwise
+		{"para 3", paraCurve(3, 2, 0.5, 0.25, 0.125, 0.5), []point{{0.25, 0.03125}, {0.5, 0.25}, {1, 0.5625}}},
+		// y = (ax+b)^g + e for x >= d, cx + f otherwise
+		{"para 4", paraCurve(4, 2, 0.5, 0.25, 0.125, 0.5, 0.0625, 0.03125), []point{{0.25, 0.0625}, {0.5, 0.3125}, {1, 0.625}}},
+	}
+	for _, tc := range table {
+		curve, err := parseCurve(tc.data)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		for _, p := range tc.points {
+			if y := curve(p.x); math.Abs(y-p.y) > 1e-4 {
+				t.Errorf("%s: f(%v) = %v, want %v", tc.name, p.x, y, p.y)
+			}
+		}
+	}
+	bad := []struct {
+		name string
+		data []byte
+	}{
+		{"missing", nil},
+		{"truncated header", []byte("curv\x00\x00\x00\x00")},
+		{"truncated curv", curvCurve(1, 2, 3)[:14]},
+		{"truncated para", paraCurve(3, 2, 0.5)},
+		{"unknown para type", paraCurve(5, 1, 1, 1, 1, 1, 1, 1, 1)},
+		{"para 1 with zero a", paraCurve(1, 2, 0, 0.25)},
+		{"para 2 with zero a", paraCurve(2, 2, 0, 0.25, 0.125)},
+		{"unknown type", []byte("sf32\x00\x00\x00\x00\x00\x00\x00\x00")},
+	}
+	for _, tc := range bad {
+		if _, err := parseCurve(tc.data); err == nil {
+			t.Errorf("%s: no error", tc.name)
+		}
+	}
+}
+
+func TestProfileSRGB(t *testing.T) {
+	srgb, err := parseICC(testProfile(srgbMatrix, srgbCurve()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !srgb.sRGB() {
+		t.Error("sRGB profile is not detected as sRGB")
+	}
+	p3, err := parseICC(testProfile(displayP3, srgbCurve()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p3.sRGB() {
+		t.Error("Display P3 profile is detected as sRGB")
+	}
+	gamma, err := parseICC(testProfile(srgbMatrix, curvCurve(563))) // gamma 2.2
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gamma.sRGB() {
+		t.Error("profile with gamma 2.2 curve is detected as sRGB")
+	}
+}
+
+func TestToSRGB(t *testing.T) {
+	p3, err := parseICC(testProfile(displayP3, srgbCurve()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := []struct{ in, want color.NRGBA }{
+		// converted with Display P3 to sRGB matrix
+		{color.NRGBA{200, 100, 50, 255}, color.NRGBA{215, 93, 31, 255}},
+		// neutral colors are kept
+		{color.NRGBA{128, 128, 128, 255}, color.NRGBA{128, 128, 128, 255}},
+		{color.NRGBA{255, 255, 255, 255}, color.NRGBA{255, 255, 255, 255}},
+		// pure P3 red is out of sRGB gamut and gets clipped
+		{color.NRGBA{255, 0, 0, 255}, color.NRGBA{255, 0, 0, 255}},
+	}
+	for _, tc := range table {
+		img := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+		img.SetNRGBA(0, 0, tc.in)
+		got := color.NRGBAModel.Convert(p3.toSRGB(img).At(0, 0)).(color.NRGBA)
+		if !closeColors(got, tc.want, 2) {
+			t.Errorf("%v: got %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func closeColors(a, b color.NRGBA, tolerance int) bool {
+	for _, d := range []int{int(a.R) - int(b.R), int(a.G) - int(b.G), int(a.B) - int(b.B), int(a.A) - int(b.A)} {
+		if d < -tolerance || d > tolerance {
+			return false
+		}
+	}
+	return true
+}
+
+// primaries adapted to D50, rows are X, Y, Z, columns are r, g, b
+var (
+	srgbMatrix = [3][3]float64{
+		{0.4360747, 0.3850649, 0.1430804},
+		{0.2225045, 0.7168786, 0.0606169},
+		{0.0139322, 0.0971045, 0.7141733},
+	}
+	displayP3 = [3][3]float64{
+		{0.5151215, 0.2919769, 0.1571045},
+		{0.2411957, 0.6922455, 0.0665588},
+		{-0.0010529, 0.0418854, 0.7840576},
+	}
+)
+
+// testProfile returns RGB matrix/TRC ICC profile with primaries m and the
+// same tone curve for all channels
+func testProfile(m [3][3]float64, curve []byte) []byte {
+	tags := []struct {
+		sig  string
+		data []byte
+	}{
+		{"rXYZ", xyzTag(m[0][0], m[1][0], m[2][0])},
+		{"gXYZ", xyzTag(m[0][1], m[1][1], m[2][1])},
+		{"bXYZ", xyzTag(m[0][2], m[1][2], m[2][2])},
+		{"rTRC", curve},
+		{"gTRC", curve},
+		{"bTRC", curve},
+	}
+	header := make([]byte, 128)
+	copy(header[12:], "mntr")
+	copy(header[16:], "RGB ")
+	copy(header[20:], "XYZ ")
+	copy(header[36:], "acsp")
+	var tagTable, data bytes.Buffer
+	binary.Write(&tagTable, binary.BigEndian, uint32(len(tags)))
+	offset := len(header) + 4 + 12*len(tags)
+	for _, tag := range tags {
+		tagTable.WriteString(tag.sig)
+		binary.Write(&tagTable, binary.BigEndian, uint32(offset+data.Len()))
+		binary.Write(&tagTable, binary.BigEndian, uint32(len(tag.data)))
+		data.Write(tag.data)
+		for data.Len()%4 != 0 {
+			data.WriteByte(0)
+		}
+	}
+	out := append(header, tagTable.Bytes()...)
+	out = append(out, data.Bytes()...)
+	binary.BigEndian.PutUint32(out, uint32(len(out)))
+	return out
+}
+
+func xyzTag(x, y, z float64) []byte {
+	b := []byte("XYZ \x00\x00\x00\x00")
+	for _, v := range []float64{x, y, z} {
+		b = append(b, s15Fixed16Bytes(v)...)
+	}
+	return b
+}
+
+// srgbCurve returns sRGB tone curve as parametric curve of type 3
+func srgbCurve() []byte { return paraCurve(3, 2.4, 1/1.055, 0.055/1.055, 1/12.92, 0.04045) }
+
+func paraCurve(typ uint16, params ...float64) []byte {
+	b := []byte("para\x00\x00\x00\x00")
+	b = append(b, byte(typ>>8), byte(typ), 0, 0)
+	for _, v := range params {
+		b = append(b, s15Fixed16Bytes(v)...)
+	}
+	return b
+}
+
+func curvCurve(values ...uint16) []byte {
+	b := []byte("curv\x00\x00\x00\x00")
+	b = append(b, make([]byte, 4)...)
+	binary.BigEndian.PutUint32(b[8:], uint32(len(values)))
+	for _, v := range values {
+		b = append(b, byte(v>>8), byte(v))
+	}
+	return b
+}
+
+func s15Fixed16Bytes(v float64) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(int32(math.Round(v*65536))))
+	return b
+}
+
+// testJPEG returns start of jpeg file with given segments, up to the start
+// of scan, which is all jpegICC reads
+func testJPEG(segments ...[]byte) []byte {
+	out := []byte{0xff, 0xd8}
+	for _, s := range segments {
+		out = append(out, s...)
+	}
+	return append(out, testSegment(0xda, []byte{0})...)
+}
+
+// testSegment returns jpeg segment with given marker and data
+func testSegment(marker byte, data []byte) []byte {
+	size := len(data) + 2
+	return append([]byte{0xff, marker, byte(size >> 8), byte(size)}, data...)
+}
+
+// iccChunk returns APP2 segment holding chunk seq of n of ICC profile
+func iccChunk(seq, n byte, data []byte) []byte {
+	return testSegment(0xe2, append([]byte{'I', 'C', 'C', '_', 'P', 'R', 'O', 'F', 'I', 'L', 'E', 0, seq, n}, data...))
+}
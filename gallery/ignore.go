@@ -0,0 +1,110 @@
+package gallery
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// NoMediaFile is a marker file name: directories holding a file with this
+	// name are skipped along with their subdirectories
+	NoMediaFile = ".nomedia"
+
+	// IgnoreFile is a name of file listing glob patterns, one per line, of
+	// files and directories to skip within directory holding it and its
+	// subdirectories. Patterns without slashes are matched against base names,
+	// patterns with slashes are matched against paths relative to directory
+	// holding IgnoreFile. Empty lines and lines starting with # are ignored.
+	IgnoreFile = ".galleryignore"
+
+	// HiddenSuffix is a suffix of marker file names: an image with a file
+	// named after it with this suffix added, like photo.jpg.hidden, is
+	// processed as usual, but left out of generated html
+	HiddenSuffix = ".hidden"
+
+	// FeaturedSuffix is a suffix of marker file names, like HiddenSuffix,
+	// for images shown in a featured section above the rest
+	FeaturedSuffix = ".featured"
+)
+
+// hasMarker reports whether image file name has a marker file with suffix
+func hasMarker(name, suffix string) (bool, error) {
+	_, err := os.Stat(name + suffix)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ignoreRules tracks patterns from IgnoreFile files seen during directory
+// walk, keyed by directory holding IgnoreFile
+type ignoreRules map[string][]string
+
+// enter is called for each directory walked; it reads IgnoreFile in dir, if
+// any, and reports whether dir should be skipped because it holds NoMediaFile
+func (r ignoreRules) enter(dir string) (skip bool, err error) {
+	if _, err := os.Stat(filepath.Join(dir, NoMediaFile)); err == nil {
+		return true, nil
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+	patterns, err := readIgnoreFile(filepath.Join(dir, IgnoreFile))
+	if err != nil {
+		return false, err
+	}
+	if len(patterns) != 0 {
+		r[dir] = patterns
+	}
+	return false, nil
+}
+
+// match reports whether p matches patterns of any IgnoreFile found in its
+// parent directories up to and including root
+func (r ignoreRules) match(root, p string) bool {
+	if len(r) == 0 {
+		return false
+	}
+	for dir := filepath.Dir(p); ; dir = filepath.Dir(dir) {
+		for _, pat := range r[dir] {
+			name := filepath.Base(p)
+			if strings.Contains(pat, "/") {
+				rel, err := filepath.Rel(dir, p)
+				if err != nil {
+					continue
+				}
+				name, pat = filepath.ToSlash(rel), strings.TrimPrefix(pat, "/")
+			}
+			if ok, _ := filepath.Match(pat, name); ok {
+				return true
+			}
+		}
+		if dir == root || dir == filepath.Dir(dir) {
+			return false
+		}
+	}
+}
+
+// readIgnoreFile returns patterns listed in IgnoreFile name; it returns no
+// error if file does not exist
+func readIgnoreFile(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var patterns []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, strings.TrimSuffix(line, "/"))
+	}
+	return patterns, sc.Err()
+}
@@ -0,0 +1,1108 @@
+package gallery
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/artyom/phash"
+	"github.com/disintegration/imaging"
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/rwcarlsen/goexif/tiff"
+)
+
+// imageSize returns image width and height in pixels as it is displayed: if
+// image has EXIF orientation requiring rotation by 90 or 270 degrees, its
+// stored dimensions are swapped.
+func imageSize(name string) (width, height int, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+	if swapsDimensions(exifOrientation(f)) {
+		return cfg.Height, cfg.Width, nil
+	}
+	return cfg.Width, cfg.Height, nil
+}
+
+// fileOrientation returns value of EXIF orientation tag of the file, see
+// exifOrientation
+func fileOrientation(name string) int {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	return exifOrientation(f)
+}
+
+// exifOrientation returns value of EXIF orientation tag, 1 to 8, or 0 if
+// file has no such tag
+func exifOrientation(f *os.File) int {
+	x, err := decodeExif(f)
+	if err != nil {
+		return 0
+	}
+	return orientationTag(x)
+}
+
+// orientationTag returns EXIF orientation value from 1 to 8, or 0 if it is
+// not set or is invalid
+func orientationTag(x *exif.Exif) int {
+	tag, err := x.Get(exif.Orientation)
+	if err != nil {
+		return 0
+	}
+	v, err := tag.Int(0)
+	if err != nil || v < 1 || v > 8 {
+		return 0
+	}
+	return v
+}
+
+// swapsDimensions reports whether EXIF orientation value means image is
+// stored rotated by 90 or 270 degrees (possibly mirrored), so its width and
+// height are swapped when displayed
+func swapsDimensions(orientation int) bool { return orientation >= 5 && orientation <= 8 }
+
+// thumbOptions configures thumbnail generation
+type thumbOptions struct {
+	transform
+	// Force makes createThumbnail overwrite existing thumbnail. Existing
+	// thumbnails are otherwise kept as is, even if they were created with
+	// different settings.
+	Force bool
+	// Filter is used to resize images
+	Filter imaging.ResampleFilter
+	// Square makes createThumbnail crop central square part of image before
+	// resizing it
+	Square bool
+	// Background is used to fill transparent areas, as jpeg has no
+	// transparency
+	Background color.Color
+	// Embedded makes createThumbnail use thumbnail embedded into EXIF
+	// instead of decoding the whole image, if it is large enough, see
+	// embeddedThumbnail
+	Embedded bool
+	// Orientation, if set, is applied instead of EXIF orientation of image
+	Orientation int
+	// Sharpen is sigma of sharpening applied after resizing, 0 disables it
+	Sharpen float64
+	// Focus, if set, is a point square crop is centered around as close as
+	// possible, see readFocus
+	Focus *focusPoint
+	// SRGB makes createThumbnail convert colors of images with embedded
+	// color profile to sRGB, as profiles are not kept, see convertProfile
+	SRGB bool
+}
+
+// focusPoint is a point of interest on image, in coordinates normalized to
+// 0..1 range, with 0,0 being top left corner
+type focusPoint struct{ X, Y float64 }
+
+// readFocus returns focus point from a sidecar file of image name: either
+// name with .focus suffix added, like photo.jpg.focus, or with its extension
+// replaced, like photo.focus. The file holds two numbers in 0..1 range
+// separated by space, horizontal and vertical coordinates, like "0.5 0.33".
+// It returns nil without error if there is no sidecar.
+func readFocus(name string) (*focusPoint, error) {
+	for _, s := range []string{name + ".focus", strings.TrimSuffix(name, filepath.Ext(name)) + ".focus"} {
+		b, err := ioutil.ReadFile(s)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var p focusPoint
+		fields := strings.Fields(string(b))
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s: want two coordinates separated by space", s)
+		}
+		for i, v := range []*float64{&p.X, &p.Y} {
+			if *v, err = strconv.ParseFloat(fields[i], 64); err != nil || *v < 0 || *v > 1 {
+				return nil, fmt.Errorf("%s: coordinates must be numbers from 0 to 1", s)
+			}
+		}
+		return &p, nil
+	}
+	return nil, nil
+}
+
+// cropSquare returns square part of img with the given side, centered around
+// focus point p as close as possible, or around image center if p is nil
+func cropSquare(img image.Image, side int, p *focusPoint) image.Image {
+	if p == nil {
+		return imaging.CropCenter(img, side, side)
+	}
+	b := img.Bounds()
+	x := clamp(int(p.X*float64(b.Dx()))-side/2, 0, b.Dx()-side)
+	y := clamp(int(p.Y*float64(b.Dy()))-side/2, 0, b.Dy()-side)
+	return imaging.Crop(img, image.Rect(x, y, x+side, y+side).Add(b.Min))
+}
+
+// clamp returns v limited to min..max range
+func clamp(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+// Supported source image formats, as returned by imageFormat
+const (
+	formatJPEG = "jpeg"
+	formatTIFF = "tiff"
+	formatGIF  = "gif"
+)
+
+// imageSignatures are leading bytes of supported source image formats
+var imageSignatures = []struct{ prefix, format string }{
+	{"\xff\xd8\xff", formatJPEG},
+	{"II*\x00", formatTIFF}, // little-endian
+	{"MM\x00*", formatTIFF}, // big-endian
+	{"GIF87a", formatGIF},
+	{"GIF89a", formatGIF},
+}
+
+// imageFormat returns format of image file detected by its leading bytes, or
+// an empty string if file is not an image of supported format. This allows to
+// tell empty files or error pages saved under image names apart from images
+// that fail to decode, and to find images without extensions.
+func imageFormat(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	head := make([]byte, 6)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	for _, sig := range imageSignatures {
+		if strings.HasPrefix(string(head[:n]), sig.prefix) {
+			return sig.format, nil
+		}
+	}
+	return "", nil
+}
+
+// isAnimated reports whether gif file has more than one frame
+func isAnimated(name string) (bool, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	g, err := gif.DecodeAll(f)
+	if err != nil {
+		return false, err
+	}
+	return len(g.Image) > 1, nil
+}
+
+// createThumbnail creates thumbnail dst from image src and returns its size.
+// If dst already exists, it is left untouched unless opts.Force is set, and
+// returned size is 0.
+func createThumbnail(ctx context.Context, opts thumbOptions, dst, src string) (int64, error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if opts.Force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	thumb, err := os.OpenFile(dst, flags, 0666)
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	var defuse bool
+	defer func() {
+		if defuse {
+			return
+		}
+		_ = os.Remove(dst)
+	}()
+	defer thumb.Close()
+
+	var img image.Image
+	var ok bool
+	if opts.Embedded {
+		img, ok = embeddedThumbnail(opts, src)
+	}
+	if !ok {
+		if img, err = scaledImage(ctx, opts, src); err != nil {
+			return 0, err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	img = flatten(img, opts.Background)
+	if opts.SRGB {
+		img = convertProfile(img, src)
+	}
+	if opts.Sharpen > 0 {
+		img = imaging.Sharpen(img, opts.Sharpen)
+	}
+	if err = jpeg.Encode(thumb, img, &jpeg.Options{Quality: 90}); err != nil {
+		return 0, err
+	}
+	fi, err := thumb.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if err = thumb.Close(); err != nil {
+		return 0, err
+	}
+	defuse = true
+	return fi.Size(), nil
+}
+
+// scaledImage decodes image src and scales it as configured by opts
+func scaledImage(ctx context.Context, opts thumbOptions, src string) (image.Image, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	img, err := decodeOriented(ctxReader{ctx, f}, opts.Orientation)
+	if err != nil {
+		return nil, err
+	}
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	if opts.Square {
+		if w > h {
+			w = h
+		} else {
+			h = w
+		}
+		img = cropSquare(img, w, opts.Focus)
+	}
+	if w, h, err = opts.newDimensions(w, h); err != nil {
+		return nil, err
+	}
+	return resizeImage(img, w, h, opts.Filter)
+}
+
+// embeddedThumbnail scales thumbnail embedded into EXIF of jpeg file src as
+// configured by opts. It reports false if there is no embedded thumbnail, or
+// it is smaller than required, or its aspect ratio differs from the image
+// one, as such thumbnails are usually letterboxed.
+func embeddedThumbnail(opts thumbOptions, src string) (image.Image, bool) {
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+	cfg, err := jpeg.DecodeConfig(f)
+	if err != nil {
+		return nil, false
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, false
+	}
+	x, err := decodeExif(f)
+	if err != nil {
+		return nil, false
+	}
+	b, err := x.JpegThumbnail()
+	if err != nil {
+		return nil, false
+	}
+	img, err := jpeg.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, false
+	}
+	tw, th := img.Bounds().Dx(), img.Bounds().Dy()
+	w, h := cfg.Width, cfg.Height
+	if d := tw*h - th*w; th == 0 || 50*d > th*w || -50*d > th*w { // differ by over 2%
+		return nil, false
+	}
+	o := opts.Orientation
+	if o == 0 {
+		o = orientationTag(x)
+	}
+	if img = orient(img, o); swapsDimensions(o) {
+		w, h = h, w
+	}
+	if opts.Square {
+		if w > h {
+			w = h
+		} else {
+			h = w
+		}
+		side := img.Bounds().Dx()
+		if dy := img.Bounds().Dy(); dy < side {
+			side = dy
+		}
+		img = cropSquare(img, side, opts.Focus)
+	}
+	if w, h, err = opts.newDimensions(w, h); err != nil {
+		return nil, false
+	}
+	if img.Bounds().Dx() < w || img.Bounds().Dy() < h {
+		return nil, false
+	}
+	img, err = resizeImage(img, w, h, opts.Filter)
+	return img, err == nil
+}
+
+// decodeOriented decodes image from r applying orientation o, or EXIF
+// orientation if o is 0
+func decodeOriented(r io.Reader, o int) (image.Image, error) {
+	if o == 0 {
+		return imaging.Decode(r, imaging.AutoOrientation(true))
+	}
+	img, err := imaging.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	return orient(img, o), nil
+}
+
+// orient transforms image stored with EXIF orientation value o, so that it is
+// displayed as intended
+func orient(img image.Image, o int) image.Image {
+	switch o {
+	case 2:
+		return imaging.FlipH(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.FlipV(img)
+	case 5:
+		return imaging.Transpose(img)
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		return imaging.Transverse(img)
+	case 8:
+		return imaging.Rotate90(img)
+	}
+	return img
+}
+
+// convertProfile returns img decoded from file src with colors converted to
+// sRGB from color profile embedded into src. Images without profile, or with
+// unsupported or malformed one, are assumed to be in sRGB and returned as is.
+func convertProfile(img image.Image, src string) image.Image {
+	p, err := readICC(src)
+	if err != nil || p == nil || p.sRGB() {
+		return img
+	}
+	return p.toSRGB(img)
+}
+
+// convertToJPEG creates jpeg copy of image src at dst, applying orientation o,
+// or EXIF orientation if o is 0, as this information is lost on conversion,
+// and filling transparent areas with bg color. With srgb set, colors are
+// converted to sRGB, see convertProfile. It returns size of created file. If
+// dst already exists, it returns right away with zero size.
+func convertToJPEG(ctx context.Context, dst, src string, o int, bg color.Color, srgb bool) (int64, error) {
+	if _, err := os.Stat(dst); err == nil {
+		return 0, nil
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	img, err := decodeOriented(ctxReader{ctx, f}, o)
+	if err != nil {
+		return 0, err
+	}
+	img = flatten(img, bg)
+	if srgb {
+		img = convertProfile(img, src)
+	}
+	f2, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return 0, err
+	}
+	defer f2.Close()
+	if err := jpeg.Encode(f2, img, &jpeg.Options{Quality: 95}); err != nil {
+		_ = os.Remove(f2.Name())
+		return 0, err
+	}
+	fi, err := f2.Stat()
+	if err != nil {
+		_ = os.Remove(f2.Name())
+		return 0, err
+	}
+	if err := f2.Close(); err != nil {
+		_ = os.Remove(f2.Name())
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// copyOptions configures linkOrCopy
+type copyOptions struct {
+	// Verify makes linkOrCopy compare existing destination with source and
+	// replace it if they differ
+	Verify bool
+	// NoLink makes linkOrCopy always copy files and never create hard
+	// links; existing destinations hardlinked to sources are replaced with
+	// copies
+	NoLink bool
+}
+
+// flatten returns img drawn over bg color if it has transparent areas,
+// otherwise it returns img as is
+func flatten(img image.Image, bg color.Color) image.Image {
+	if o, ok := img.(interface{ Opaque() bool }); ok && o.Opaque() {
+		return img
+	}
+	b := img.Bounds()
+	return imaging.Overlay(imaging.New(b.Dx(), b.Dy(), bg), img, image.Pt(0, 0), 1)
+}
+
+// parseColor parses color in #rrggbb or #rgb hex notation, leading # is
+// optional
+func parseColor(s string) (color.Color, error) {
+	h := strings.TrimPrefix(s, "#")
+	if len(h) == 3 {
+		h = string([]byte{h[0], h[0], h[1], h[1], h[2], h[2]})
+	}
+	b, err := hex.DecodeString(h)
+	if err != nil || len(b) != 3 {
+		return nil, fmt.Errorf("invalid color %q, want #rrggbb", s)
+	}
+	return color.NRGBA{R: b[0], G: b[1], B: b[2], A: 0xff}, nil
+}
+
+// linkOrCopy creates a copy of a source file at its destination. It first
+// checks whether dst already existst and returns nil right away if it does,
+// unless opts require to replace it. If dst does not exist, it tries to create
+// a hard link, unless opts.NoLink is set. If that fails, it copies file. It
+// returns how dst was created and number of bytes copied.
+func linkOrCopy(ctx context.Context, opts copyOptions, dst, src string) (copyMode, int64, error) {
+	if fi, err := os.Stat(dst); err == nil {
+		var replace bool
+		if opts.NoLink {
+			sfi, err := os.Stat(src)
+			if err != nil {
+				return 0, 0, err
+			}
+			replace = os.SameFile(fi, sfi)
+		}
+		if !replace && opts.Verify {
+			same, err := sameContent(dst, src)
+			if err != nil {
+				return 0, 0, err
+			}
+			replace = !same
+		}
+		if !replace {
+			return copyExisting, 0, nil
+		}
+		if err := os.Remove(dst); err != nil {
+			return 0, 0, err
+		}
+	}
+	if !opts.NoLink {
+		if err := os.Link(src, dst); err == nil {
+			return copyLinked, 0, nil
+		}
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	f2, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f2.Close()
+	n, err := io.Copy(f2, ctxReader{ctx, f})
+	if err != nil {
+		_ = os.Remove(f2.Name())
+		return 0, 0, err
+	}
+	return copyCopied, n, f2.Close()
+}
+
+// ctxReader is an io.Reader failing with context error once context is
+// canceled, so that long reads of large files can be interrupted
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// copyMode tells how linkOrCopy created its destination
+type copyMode int
+
+const (
+	copyExisting copyMode = iota // destination already existed
+	copyLinked                   // destination is a hard link to source
+	copyCopied                   // destination is a copy of source
+)
+
+// sameContent reports whether two files have the same content
+func sameContent(name1, name2 string) (bool, error) {
+	fi1, err := os.Stat(name1)
+	if err != nil {
+		return false, err
+	}
+	fi2, err := os.Stat(name2)
+	if err != nil {
+		return false, err
+	}
+	if os.SameFile(fi1, fi2) {
+		return true, nil
+	}
+	if fi1.Size() != fi2.Size() {
+		return false, nil
+	}
+	h1, err := hashers[HashFNV].Hash(name1)
+	if err != nil {
+		return false, err
+	}
+	h2, err := hashers[HashFNV].Hash(name2)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(h1, h2), nil
+}
+
+// imagePhash returns perceptual hash of an image read from the file
+func imagePhash(s string) (uint64, error) {
+	f, err := os.Open(s)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	img, err := imaging.Decode(f, imaging.AutoOrientation(true))
+	if err != nil {
+		return 0, err
+	}
+	return phash.Get(img, func(img image.Image, w, h int) image.Image {
+		return imaging.Resize(img, w, h, imaging.Lanczos)
+	})
+}
+
+// rotatedPhashes returns perceptual hashes of an image read from the file,
+// rotated by 90, 180 and 270 degrees
+func rotatedPhashes(s string) ([]uint64, error) {
+	f, err := os.Open(s)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, err := imaging.Decode(f, imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, err
+	}
+	resize := func(img image.Image, w, h int) image.Image {
+		return imaging.Resize(img, w, h, imaging.Lanczos)
+	}
+	var out []uint64
+	for _, rotate := range []func(image.Image) *image.NRGBA{imaging.Rotate90, imaging.Rotate180, imaging.Rotate270} {
+		h, err := phash.Get(rotate(img), resize)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, h)
+	}
+	return out, nil
+}
+
+// Image time sources, see Options.TimeFrom
+const (
+	TimeFromExif           = "exif"             // EXIF only, image without EXIF time is an error
+	TimeFromExifOrMtime    = "exif-or-mtime"    // EXIF, then file mtime
+	TimeFromExifOrFilename = "exif-or-filename" // EXIF, then file name, then file mtime
+	TimeFromFilename       = "filename"         // file name, then file mtime
+)
+
+// TimeSources lists all supported image time sources
+var TimeSources = []string{TimeFromExif, TimeFromExifOrMtime, TimeFromExifOrFilename, TimeFromFilename}
+
+func validTimeSource(s string) bool {
+	for _, v := range TimeSources {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// imageTime returns image time taken from the source specified by from, which
+// must be one of TimeSources. Mtime of the file is used as a last resort for
+// all sources except TimeFromExif.
+//
+// If tz is not nil, times without explicit offset are interpreted in this
+// zone and returned time is presented in it. Otherwise such times are
+// interpreted as local and returned time is in UTC.
+//
+// Reasons EXIF time could not be used are reported with logf.
+func imageTime(name, from string, tz *time.Location, logf func(format string, v ...interface{})) (time.Time, error) {
+	loc, out := time.Local, time.UTC
+	if tz != nil {
+		loc, out = tz, tz
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+	if from != TimeFromFilename {
+		t, err := exifImageTime(f, loc)
+		if err == nil {
+			return t.In(out), nil
+		}
+		if from == TimeFromExif {
+			return time.Time{}, fmt.Errorf("%q: no EXIF time found: %w", name, err)
+		}
+		logf("%s: %v, falling back to other time sources", name, err)
+	}
+	if from == TimeFromExifOrFilename || from == TimeFromFilename {
+		if t, ok := filenameTime(filepath.Base(name), loc); ok {
+			return t.In(out), nil
+		}
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime().In(out), nil
+}
+
+// exposureBias returns EXIF exposure bias of an image in EV, or 0 if it is
+// unknown
+func exposureBias(name string) float64 {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	x, err := decodeExif(f)
+	if err != nil {
+		return 0
+	}
+	tag, err := x.Get(exif.ExposureBiasValue)
+	if err != nil {
+		return 0
+	}
+	num, den, err := tag.Rat2(0)
+	if err != nil || den == 0 {
+		return 0
+	}
+	return float64(num) / float64(den)
+}
+
+// cameraInfo returns camera model followed by lens model, and exposure
+// settings like "1/250 s, f/4, ISO 100, 50 mm" read from EXIF of an image.
+// Either is empty if respective tags are missing.
+func cameraInfo(name string) (camera, exposure string) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", ""
+	}
+	defer f.Close()
+	x, err := decodeExif(f)
+	if err != nil {
+		return "", ""
+	}
+	str := func(n exif.FieldName) string {
+		tag, err := x.Get(n)
+		if err != nil {
+			return ""
+		}
+		s, _ := tag.StringVal()
+		return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+	}
+	rat := func(n exif.FieldName) float64 {
+		tag, err := x.Get(n)
+		if err != nil {
+			return 0
+		}
+		num, den, err := tag.Rat2(0)
+		if err != nil || den == 0 || num <= 0 {
+			return 0
+		}
+		return float64(num) / float64(den)
+	}
+	// models usually repeat the make, like "Canon" and "Canon EOS R5"
+	switch maker, model := str(exif.Make), str(exif.Model); {
+	case model == "":
+		camera = maker
+	case maker == "" || strings.HasPrefix(strings.ToLower(model), strings.ToLower(maker)):
+		camera = model
+	default:
+		camera = maker + " " + model
+	}
+	if lens := str(exif.LensModel); lens != "" {
+		if camera != "" {
+			camera += ", "
+		}
+		camera += lens
+	}
+	var parts []string
+	switch t := rat(exif.ExposureTime); {
+	case t == 0:
+	case t < 1:
+		parts = append(parts, fmt.Sprintf("1/%.0f s", 1/t))
+	default:
+		parts = append(parts, strconv.FormatFloat(t, 'f', -1, 64)+" s")
+	}
+	if n := rat(exif.FNumber); n != 0 {
+		parts = append(parts, "f/"+strconv.FormatFloat(n, 'f', -1, 64))
+	}
+	if tag, err := x.Get(exif.ISOSpeedRatings); err == nil {
+		if iso, err := tag.Int(0); err == nil && iso > 0 {
+			parts = append(parts, "ISO "+strconv.Itoa(iso))
+		}
+	}
+	if l := rat(exif.FocalLength); l != 0 {
+		parts = append(parts, strconv.FormatFloat(l, 'f', -1, 64)+" mm")
+	}
+	return camera, strings.Join(parts, ", ")
+}
+
+// exifHeadSize is the amount of data decodeExif reads from the beginning of
+// file at first; it is enough to hold EXIF of jpeg files, which is stored in
+// APP1 segment limited to 64KiB
+const exifHeadSize = 256 << 10
+
+// decodeExif decodes EXIF from the first exifHeadSize bytes of f, so that
+// huge files are not read into memory as a whole. If EXIF is not found there,
+// it falls back to decoding from the whole file only if it may be further:
+// for jpeg files, if the head ends before the start of image data, as EXIF is
+// stored in one of metadata segments preceding it; TIFF files can have it
+// anywhere.
+func decodeExif(f *os.File) (*exif.Exif, error) {
+	lr := &io.LimitedReader{R: f, N: exifHeadSize}
+	meta, err := exif.Decode(lr)
+	if err == nil || lr.N > 0 {
+		return meta, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	head := make([]byte, exifHeadSize)
+	if _, err := io.ReadFull(f, head); err != nil {
+		return nil, err
+	}
+	if !tiffHeader(head) && !jpegHeadTruncated(head) {
+		return meta, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return exif.Decode(f)
+}
+
+// tiffHeader reports whether b starts with TIFF signature
+func tiffHeader(b []byte) bool {
+	return bytes.HasPrefix(b, []byte("II*\x00")) || bytes.HasPrefix(b, []byte("MM\x00*"))
+}
+
+// jpegHeadTruncated reports whether b is the beginning of jpeg file ending
+// within its metadata segments, before the start of image data
+func jpegHeadTruncated(b []byte) bool {
+	if !bytes.HasPrefix(b, []byte{0xff, 0xd8}) {
+		return false
+	}
+	for pos := 2; ; {
+		if pos+2 > len(b) {
+			return true
+		}
+		if b[pos] != 0xff {
+			return false // malformed
+		}
+		switch marker := b[pos+1]; {
+		case marker == 0xff: // fill byte
+			pos++
+			continue
+		case marker == 0xda || marker == 0xd9: // start of scan, end of image
+			return false
+		case marker == 0x01 || marker >= 0xd0 && marker <= 0xd7: // no payload
+			pos += 2
+			continue
+		}
+		if pos+4 > len(b) {
+			return true
+		}
+		pos += 2 + int(binary.BigEndian.Uint16(b[pos+2:]))
+	}
+}
+
+// filenamePatterns are common camera and phone file naming conventions with
+// embedded date; first submatch of each regexp is parsed using layout
+var filenamePatterns = []struct {
+	re     *regexp.Regexp
+	layout string
+}{
+	// IMG_20240115_102233.jpg, PXL_20240115_102233123.jpg, 20240115_102233.jpg
+	{regexp.MustCompile(`(?:^|[^0-9])(\d{8}_\d{6})`), "20060102_150405"},
+	// 2024-01-15 10.22.33.jpg
+	{regexp.MustCompile(`(?:^|[^0-9])(\d{4}-\d{2}-\d{2} \d{2}\.\d{2}\.\d{2})(?:[^0-9]|$)`), "2006-01-02 15.04.05"},
+	// WhatsApp: IMG-20240115-WA0001.jpg
+	{regexp.MustCompile(`^IMG-(\d{8})-WA\d{4}`), "20060102"},
+}
+
+// filenameTime extracts time from file name, interpreting it in the given
+// location. It reports whether name matched any of the filenamePatterns.
+func filenameTime(name string, loc *time.Location) (time.Time, bool) {
+	for _, p := range filenamePatterns {
+		m := p.re.FindStringSubmatch(name)
+		if m == nil {
+			continue
+		}
+		if t, err := time.ParseInLocation(p.layout, m[1], loc); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// EXIF 2.31 tags holding UTC offsets of corresponding time tags, as in
+// "+02:00"; exif package does not know about them, they're loaded by
+// offsetParser
+const (
+	offsetTime          exif.FieldName = "OffsetTime"
+	offsetTimeOriginal  exif.FieldName = "OffsetTimeOriginal"
+	offsetTimeDigitized exif.FieldName = "OffsetTimeDigitized"
+)
+
+func init() { exif.RegisterParsers(offsetParser{}) }
+
+// offsetParser is an exif.Parser loading offset time tags from EXIF sub-IFD
+type offsetParser struct{}
+
+func (offsetParser) Parse(x *exif.Exif) error {
+	tag, err := x.Get(exif.ExifIFDPointer)
+	if err != nil {
+		return nil
+	}
+	offset, err := tag.Int64(0)
+	if err != nil {
+		return nil
+	}
+	r := bytes.NewReader(x.Raw)
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		return nil
+	}
+	dir, _, err := tiff.DecodeDir(r, x.Tiff.Order)
+	if err != nil {
+		return nil
+	}
+	x.LoadTags(dir, map[uint16]exif.FieldName{
+		0x9010: offsetTime,
+		0x9011: offsetTimeOriginal,
+		0x9012: offsetTimeDigitized,
+	}, false)
+	return nil
+}
+
+// exifImageTime returns time from EXIF of f, trying DateTimeOriginal, DateTime
+// and DateTimeDigitized fields. Returned error tells why time is unavailable:
+// file has no EXIF, EXIF is malformed, it has no time fields, or their values
+// cannot be parsed.
+func exifImageTime(f *os.File, loc *time.Location) (time.Time, error) {
+	x, err := decodeExif(f)
+	switch {
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		return time.Time{}, errors.New("no EXIF")
+	case err != nil:
+		return time.Time{}, fmt.Errorf("malformed EXIF: %w", err)
+	}
+	fields := []struct{ field, offsetField exif.FieldName }{
+		{exif.DateTimeOriginal, offsetTimeOriginal},
+		{exif.DateTime, offsetTime},
+		{exif.DateTimeDigitized, offsetTimeDigitized},
+	}
+	err = errors.New("EXIF has no time fields")
+	for _, f := range fields {
+		t, err2 := exifTime(x, f.field, f.offsetField, loc)
+		switch {
+		case err2 == nil && !t.IsZero():
+			return t, nil
+		case err2 == nil:
+			err = fmt.Errorf("EXIF %s is zero", f.field)
+		case !isTagNotPresent(err2):
+			err = fmt.Errorf("EXIF %s: %w", f.field, err2)
+		}
+	}
+	return time.Time{}, err
+}
+
+// isTagNotPresent reports whether err is returned by exif.Exif.Get for absent
+// field
+func isTagNotPresent(err error) bool {
+	_, ok := err.(exif.TagNotPresentError)
+	return ok
+}
+
+// exifTime parses time from the EXIF field, it is a replacement of
+// exif.Exif.DateTime method that respects offset time tags. Time zone is taken
+// from offsetField if present, then from camera-specific tags, and if neither
+// is available, loc is used.
+func exifTime(x *exif.Exif, field, offsetField exif.FieldName, loc *time.Location) (time.Time, error) {
+	var dt time.Time
+	tag, err := x.Get(field)
+	if err != nil {
+		return dt, err
+	}
+	if tag.Format() != tiff.StringVal {
+		return dt, fmt.Errorf("%s not in string format", field)
+	}
+	const exifTimeLayout = "2006:01:02 15:04:05"
+	dateStr := strings.TrimRight(string(tag.Val), "\x00")
+	if tag, err := x.Get(offsetField); err == nil && tag.Format() == tiff.StringVal {
+		s := strings.TrimRight(string(tag.Val), "\x00")
+		if t, err := time.Parse("-07:00", s); err == nil {
+			_, offset := t.Zone()
+			return time.ParseInLocation(exifTimeLayout, dateStr, time.FixedZone("", offset))
+		}
+	}
+	if tz, _ := x.TimeZone(); tz != nil {
+		loc = tz
+	}
+	return time.ParseInLocation(exifTimeLayout, dateStr, loc)
+}
+
+func resizeImage(img image.Image, width, height int, filter imaging.ResampleFilter) (image.Image, error) {
+	return imaging.Resize(img, width, height, filter), nil
+}
+
+// Filters maps names of supported thumbnail resampling filters, from the
+// fastest to the slowest, to their implementations. Faster filters produce
+// blockier (nearest, box) or softer (linear) thumbnails; catmullrom is a good
+// balance of speed and sharpness, lanczos is the sharpest, but the slowest.
+var Filters = map[string]imaging.ResampleFilter{
+	"nearest":    imaging.NearestNeighbor,
+	"box":        imaging.Box,
+	"linear":     imaging.Linear,
+	"catmullrom": imaging.CatmullRom,
+	"lanczos":    imaging.Lanczos,
+}
+
+// FilterNames lists keys of Filters from the fastest to the slowest
+var FilterNames = []string{"nearest", "box", "linear", "catmullrom", "lanczos"}
+
+// DefaultFilter is a name of filter used for thumbnails by default
+const DefaultFilter = "catmullrom"
+
+type transform struct {
+	Width     int
+	Height    int
+	MaxWidth  int
+	MaxHeight int
+	Limit     int // maximum number of destination pixels, see DefaultMaxDestPixels
+}
+
+func (tr transform) newDimensions(origWidth, origHeight int) (width, height int, err error) {
+	if origWidth == 0 || origHeight == 0 {
+		return 0, 0, errors.New("invalid source dimensions")
+	}
+	var w, h int
+	switch {
+	case tr.MaxWidth > 0 || tr.MaxHeight > 0:
+		w, h = tr.MaxWidth, tr.MaxHeight
+		// if only one max dimension specified, calculate another using
+		// original aspect ratio
+		if w == 0 {
+			w = origWidth * h / origHeight
+		}
+		if h == 0 {
+			h = origHeight * w / origWidth
+		}
+		if origWidth <= w && origHeight <= h {
+			// image already fits, but with only one max dimension
+			// set the other one is unbounded, so limits still apply
+			w, h = origWidth, origHeight
+		} else if tr.MaxWidth > 0 && tr.MaxHeight > 0 {
+			// maxwidth and maxheight form free aspect ratio, need
+			// to adjust w and h to match origin aspect ratio, while
+			// keeping dimensions inside max bounds
+			if float64(origWidth)/float64(origHeight) > float64(w)/float64(h) {
+				h = origHeight * w / origWidth
+			} else {
+				w = origWidth * h / origHeight
+			}
+		}
+	case tr.Width > 0 || tr.Height > 0:
+		// if both width and height specified, free aspect ratio is
+		// applied; if only one is set, original aspect ratio is kept
+		w, h = tr.Width, tr.Height
+		if w == 0 {
+			w = origWidth * h / origHeight
+		}
+		if h == 0 {
+			h = origHeight * w / origWidth
+		}
+	default:
+		return 0, 0, fmt.Errorf("invalid transform %v", tr)
+	}
+	if w >= 1<<16 || h >= 1<<16 || int64(w)*int64(h) > int64(tr.Limit) {
+		return 0, 0, errors.New("destination size exceeds limit")
+	}
+	return w, h, nil
+}
+
+// newTransform returns transform to the given dimensions, see newDimensions;
+// transforms producing, or fitting into a box of, more than limit pixels are
+// rejected
+func newTransform(width, height, maxWidth, maxHeight, limit int) (transform, error) {
+	tr := transform{
+		Width:     width,
+		Height:    height,
+		MaxWidth:  maxWidth,
+		MaxHeight: maxHeight,
+		Limit:     limit,
+	}
+	if tr.Width == 0 && tr.Height == 0 && tr.MaxWidth == 0 && tr.MaxHeight == 0 {
+		return transform{}, errors.New("no valid dimensions specified")
+	}
+	for _, v := range []int{tr.Width, tr.Height, tr.MaxWidth, tr.MaxHeight} {
+		if v >= 1<<16 {
+			return transform{}, errors.New("destination size exceeds limit")
+		}
+	}
+	// with only one of max dimensions set, the other one depends on source
+	// aspect ratio, so newDimensions has to check the result anyway
+	if int64(tr.Width)*int64(tr.Height) > int64(limit) || int64(tr.MaxWidth)*int64(tr.MaxHeight) > int64(limit) ||
+		tr.MaxWidth > limit || tr.MaxHeight > limit {
+		return transform{}, errors.New("destination size exceeds limit")
+	}
+	return tr, nil
+}
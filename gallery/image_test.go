@@ -0,0 +1,313 @@
+package gallery
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+func TestNewTransform(t *testing.T) {
+	const limit = 1 << 20
+	table := []struct {
+		name                 string
+		w, h, maxW, maxH, lm int
+		ok                   bool
+	}{
+		{"no dimensions", 0, 0, 0, 0, limit, false},
+		{"thumbnail box", 0, 0, 500, 500, limit, true},
+		{"box at limit", 0, 0, 1024, 1024, limit, true},
+		{"box area over limit", 0, 0, 1025, 1024, limit, false},
+		{"max width alone", 0, 0, 1 << 15, 0, limit, true},
+		{"max height alone over limit", 0, 0, 0, 1001, 1000, false},
+		{"exact size at limit", 1024, 1024, 0, 0, limit, true},
+		{"exact size over limit", 1024, 1025, 0, 0, limit, false},
+		{"width of 1<<16", 1 << 16, 1, 0, 0, 1 << 30, false},
+		{"width below 1<<16", 1<<16 - 1, 1, 0, 0, 1 << 30, true},
+		{"max height of 1<<16", 0, 0, 1, 1 << 16, 1 << 30, false},
+		{"area overflowing int32", 1<<16 - 1, 1<<16 - 1, 0, 0, 1<<31 - 1, false},
+		{"box area overflowing int32", 0, 0, 1<<16 - 1, 1<<16 - 1, 1<<31 - 1, false},
+	}
+	for _, tc := range table {
+		_, err := newTransform(tc.w, tc.h, tc.maxW, tc.maxH, tc.lm)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: newTransform(%d, %d, %d, %d, %d) error: %v", tc.name, tc.w, tc.h, tc.maxW, tc.maxH, tc.lm, err)
+		}
+	}
+}
+
+func TestNewDimensions(t *testing.T) {
+	table := []struct {
+		name         string
+		tr           transform
+		origW, origH int
+		wantW, wantH int
+		ok           bool
+	}{
+		{"fits as is", transform{MaxWidth: 500, MaxHeight: 500, Limit: 1 << 26}, 400, 300, 400, 300, true},
+		{"landscape into box", transform{MaxWidth: 500, MaxHeight: 500, Limit: 1 << 26}, 1000, 500, 500, 250, true},
+		{"portrait into box", transform{MaxWidth: 500, MaxHeight: 500, Limit: 1 << 26}, 500, 1000, 250, 500, true},
+		{"zero source", transform{MaxWidth: 500, MaxHeight: 500, Limit: 1 << 26}, 0, 100, 0, 0, false},
+		// only max width is set, height follows a very tall source
+		{"height of 1<<16", transform{MaxWidth: 100, Limit: 1 << 30}, 200, 1 << 17, 0, 0, false},
+		{"area over limit", transform{MaxWidth: 1000, Limit: 1 << 20}, 2000, 4000, 0, 0, false},
+		{"fits max width, area over limit", transform{MaxWidth: 1000, Limit: 1 << 20}, 1000, 60000, 0, 0, false},
+		{"fits max width, height of 1<<16", transform{MaxWidth: 1000, Limit: 1 << 30}, 800, 1 << 16, 0, 0, false},
+		{"fits max width within limit", transform{MaxWidth: 1000, Limit: 1 << 20}, 1000, 1000, 1000, 1000, true},
+		{"area overflowing int32", transform{Width: 1<<16 - 1, Height: 1<<16 - 1, Limit: 1<<31 - 1}, 10, 10, 0, 0, false},
+	}
+	for _, tc := range table {
+		w, h, err := tc.tr.newDimensions(tc.origW, tc.origH)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if tc.ok && (w != tc.wantW || h != tc.wantH) {
+			t.Errorf("%s: got %dx%d, want %dx%d", tc.name, w, h, tc.wantW, tc.wantH)
+		}
+	}
+}
+
+func TestFilenameTime(t *testing.T) {
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	table := []struct {
+		name string
+		want string // time in RFC 3339 format, empty if name should not match
+	}{
+		{"IMG_20240115_102233.jpg", "2024-01-15T10:22:33+02:00"},
+		{"PXL_20240115_102233123.jpg", "2024-01-15T10:22:33+02:00"},
+		{"20240115_102233.jpg", "2024-01-15T10:22:33+02:00"},
+		{"VID_20241231_235959~2.jpg", "2024-12-31T23:59:59+02:00"},
+		{"2024-01-15 10.22.33.jpg", "2024-01-15T10:22:33+02:00"},
+		{"Photo 2024-01-15 10.22.33.jpeg", "2024-01-15T10:22:33+02:00"},
+		{"IMG-20240115-WA0001.jpg", "2024-01-15T00:00:00+02:00"},
+
+		{"DSC_0001.jpg", ""},
+		{"IMG_1234.jpg", ""},
+		{"photo.jpg", ""},
+		{"", ""},
+		// too many digits before the date
+		{"120240115_102233.jpg", ""},
+		{"2024-01-15 10.22.334.jpg", ""},
+		{"12024-01-15 10.22.33.jpg", ""},
+		// date only, without time
+		{"20240115.jpg", ""},
+		{"2024-01-15.jpg", ""},
+		// invalid dates and times
+		{"IMG_20241315_102233.jpg", ""},
+		{"IMG_20240230_102233.jpg", ""},
+		{"IMG_20240115_250000.jpg", ""},
+		{"2024-01-15 10.61.00.jpg", ""},
+		{"IMG-20241301-WA0001.jpg", ""},
+		// WhatsApp pattern is anchored and needs a WA suffix
+		{"xIMG-20240115-WA0001.jpg", ""},
+		{"IMG-20240115-0001.jpg", ""},
+	}
+	for _, tc := range table {
+		got, ok := filenameTime(tc.name, loc)
+		if tc.want == "" {
+			if ok {
+				t.Errorf("%q: unexpected match %v", tc.name, got)
+			}
+			continue
+		}
+		want, err := time.Parse(time.RFC3339, tc.want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Errorf("%q: no match, want %v", tc.name, want)
+			continue
+		}
+		if !got.Equal(want) {
+			t.Errorf("%q: got %v, want %v", tc.name, got, want)
+		}
+		if got.Location() != loc {
+			t.Errorf("%q: got time in %v, want %v", tc.name, got.Location(), loc)
+		}
+	}
+}
+
+func TestImageSize(t *testing.T) {
+	dir := t.TempDir()
+	const w, h = 40, 30
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		for orientation := 0; orientation <= 8; orientation++ {
+			name := filepath.Join(dir, order.String()+strconv.Itoa(orientation)+".jpg")
+			if err := ioutil.WriteFile(name, jpegWithOrientation(t, w, h, order, orientation), 0666); err != nil {
+				t.Fatal(err)
+			}
+			if got := fileOrientation(name); got != orientation {
+				t.Errorf("%s, orientation %d: fileOrientation returned %d", order, orientation, got)
+			}
+			wantW, wantH := w, h
+			if orientation >= 5 {
+				wantW, wantH = h, w
+			}
+			gotW, gotH, err := imageSize(name)
+			if err != nil {
+				t.Fatalf("%s, orientation %d: %v", order, orientation, err)
+			}
+			if gotW != wantW || gotH != wantH {
+				t.Errorf("%s, orientation %d: got %dx%d, want %dx%d", order, orientation, gotW, gotH, wantW, wantH)
+			}
+		}
+	}
+}
+
+func TestSwapsDimensions(t *testing.T) {
+	// orientations 5 to 8 rotate image by 90 degrees, possibly mirroring it
+	want := []bool{false, false, false, false, false, true, true, true, true, false}
+	for orientation, swaps := range want {
+		if got := swapsDimensions(orientation); got != swaps {
+			t.Errorf("swapsDimensions(%d) = %v, want %v", orientation, got, swaps)
+		}
+	}
+}
+
+// jpegWithOrientation returns w by h jpeg image with EXIF segment holding
+// orientation tag encoded with the given byte order; orientation 0 means no
+// EXIF segment
+func jpegWithOrientation(t *testing.T, w, h int, order binary.ByteOrder, orientation int) []byte {
+	t.Helper()
+	var img bytes.Buffer
+	if err := jpeg.Encode(&img, image.NewGray(image.Rect(0, 0, w, h)), nil); err != nil {
+		t.Fatal(err)
+	}
+	if orientation == 0 {
+		return img.Bytes()
+	}
+	out := append([]byte{0xff, 0xd8}, exifSegment(t, order, orientation, 0)...)
+	return append(out, img.Bytes()[2:]...) // skip start of image marker
+}
+
+// exifSegment returns jpeg APP1 segment with EXIF holding orientation tag
+// encoded with the given byte order, followed by pad zero bytes
+func exifSegment(t *testing.T, order binary.ByteOrder, orientation, pad int) []byte {
+	t.Helper()
+	var tiff bytes.Buffer
+	if order == binary.LittleEndian {
+		tiff.WriteString("II")
+	} else {
+		tiff.WriteString("MM")
+	}
+	for _, v := range []interface{}{
+		uint16(42), uint32(8), // TIFF header, offset of the first IFD
+		uint16(1),                            // number of IFD entries
+		uint16(0x0112), uint16(3), uint32(1), // orientation tag, SHORT type, 1 value
+		uint16(orientation), uint16(0), uint32(0), // value padded to 4 bytes, no next IFD
+	} {
+		if err := binary.Write(&tiff, order, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tiff.Write(make([]byte, pad))
+	return testSegment(0xe1, append([]byte("Exif\x00\x00"), tiff.Bytes()...))
+}
+
+func TestDecodeExif(t *testing.T) {
+	var img bytes.Buffer
+	if err := jpeg.Encode(&img, image.NewGray(image.Rect(0, 0, 40, 30)), nil); err != nil {
+		t.Fatal(err)
+	}
+	soi, body := []byte{0xff, 0xd8}, img.Bytes()[2:]
+	small := exifSegment(t, binary.BigEndian, 6, 0)
+	large := exifSegment(t, binary.LittleEndian, 6, 60000)
+	// padding returns APP2 segments n bytes long in total
+	padding := func(n int) []byte {
+		var out []byte
+		for n > 0 {
+			size := n - 4
+			if size > 65533 {
+				size = 65533
+			}
+			if rest := n - size - 4; rest > 0 && rest < 4 {
+				size -= 4
+			}
+			out = append(out, testSegment(0xe2, make([]byte, size))...)
+			n -= size + 4
+		}
+		return out
+	}
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	table := []struct {
+		name string
+		data []byte
+		want int // orientation decodeExif should find, 0 for none
+	}{
+		{"exif first", join(soi, small, body), 6},
+		{"exif after other segments", join(soi, padding(1000), small, body), 6},
+		{"exif after head", join(soi, padding(exifHeadSize), small, body), 6},
+		{"exif across head end", join(soi, padding(exifHeadSize-1000), large, body), 6},
+		{"no exif", join(soi, body), 0},
+		{"no exif in large file", join(soi, body, make([]byte, exifHeadSize)), 0},
+		// segment looking like EXIF past the end of image is only found
+		// when reading the whole file, which is not done once image data
+		// starts within the head
+		{"exif-like data past image data", join(soi, body, make([]byte, exifHeadSize), small), 0},
+	}
+	dir := t.TempDir()
+	for i, tc := range table {
+		name := filepath.Join(dir, strconv.Itoa(i)+".jpg")
+		if err := ioutil.WriteFile(name, tc.data, 0666); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		x, err := decodeExif(f)
+		f.Close()
+		if tc.want == 0 {
+			if err == nil {
+				t.Errorf("%s: unexpected EXIF found", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if got := orientationTag(x); got != tc.want {
+			t.Errorf("%s: got orientation %d, want %d", tc.name, got, tc.want)
+		}
+		// the same EXIF is found by decoding the whole file
+		full, err := exif.Decode(bytes.NewReader(tc.data))
+		if err != nil {
+			t.Fatalf("%s: decoding whole file: %v", tc.name, err)
+		}
+		if !bytes.Equal(x.Raw, full.Raw) {
+			t.Errorf("%s: EXIF differs from one decoded from the whole file", tc.name)
+		}
+	}
+}
+
+func TestJpegHeadTruncated(t *testing.T) {
+	table := []struct {
+		name string
+		head []byte
+		want bool
+	}{
+		{"not a jpeg", []byte("II*\x00 some tiff data"), false},
+		{"start of scan", []byte{0xff, 0xd8, 0xff, 0xe0, 0, 4, 1, 2, 0xff, 0xda, 0, 2}, false},
+		{"end of image", []byte{0xff, 0xd8, 0xff, 0xd9}, false},
+		{"within segment", []byte{0xff, 0xd8, 0xff, 0xe1, 0x10, 0, 'E', 'x'}, true},
+		{"after segment", []byte{0xff, 0xd8, 0xff, 0xe0, 0, 4, 1, 2}, true},
+		{"within segment header", []byte{0xff, 0xd8, 0xff, 0xe0, 0, 4, 1, 2, 0xff}, true},
+		{"fill bytes", []byte{0xff, 0xd8, 0xff, 0xff, 0xff, 0xda, 0, 2}, false},
+		{"malformed", []byte{0xff, 0xd8, 0x00, 0x00, 0x00, 0x00}, false},
+	}
+	for _, tc := range table {
+		if got := jpegHeadTruncated(tc.head); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
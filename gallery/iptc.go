@@ -0,0 +1,131 @@
+package gallery
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"unicode/utf8"
+)
+
+// iptcKeywords returns IPTC keywords stored in jpeg file. It returns nil
+// without error if file has no IPTC metadata.
+func iptcKeywords(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b, err := jpegSegment(bufio.NewReader(f), 0xED, []byte("Photoshop 3.0\x00"))
+	if err != nil || b == nil {
+		return nil, err
+	}
+	iptc := photoshopResource(b, 0x0404)
+	if iptc == nil {
+		return nil, nil
+	}
+	var out []string
+	var utf bool // whether coded character set is UTF-8
+	for len(iptc) >= 5 && iptc[0] == 0x1C {
+		record, dataset := iptc[1], iptc[2]
+		size := int(binary.BigEndian.Uint16(iptc[3:5]))
+		if size&0x8000 != 0 || 5+size > len(iptc) {
+			break // extended datasets are not used for text fields
+		}
+		data := iptc[5 : 5+size]
+		iptc = iptc[5+size:]
+		switch {
+		case record == 1 && dataset == 90:
+			utf = bytes.Equal(data, []byte("\x1b%G"))
+		case record == 2 && dataset == 25:
+			out = append(out, iptcString(data, utf))
+		}
+	}
+	return out, nil
+}
+
+// iptcString decodes IPTC text, which is either UTF-8 or, for legacy data,
+// Latin-1
+func iptcString(b []byte, utf bool) string {
+	if utf || utf8.Valid(b) {
+		return string(b)
+	}
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return string(r)
+}
+
+// jpegSegment returns payload of the first jpeg APPn segment with the given
+// marker and payload prefix; returned payload has prefix stripped. It returns
+// nil without error if no such segment found before the image data.
+func jpegSegment(r io.Reader, marker byte, prefix []byte) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:2]); err != nil {
+		return nil, err
+	}
+	if hdr[0] != 0xFF || hdr[1] != 0xD8 {
+		return nil, errors.New("not a jpeg file")
+	}
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, err
+		}
+		if hdr[0] != 0xFF {
+			return nil, errors.New("malformed jpeg segment")
+		}
+		if hdr[1] == 0xDA || hdr[1] == 0xD9 { // start of scan, end of image
+			return nil, nil
+		}
+		size := int(binary.BigEndian.Uint16(hdr[2:])) - 2
+		if size < 0 {
+			return nil, errors.New("malformed jpeg segment")
+		}
+		if hdr[1] != marker {
+			if _, err := io.CopyN(ioutil.Discard, r, int64(size)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		b := make([]byte, size)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		if bytes.HasPrefix(b, prefix) {
+			return b[len(prefix):], nil
+		}
+	}
+}
+
+// photoshopResource returns data of the image resource block with the given id
+// from a sequence of Photoshop "8BIM" resource blocks
+func photoshopResource(b []byte, id uint16) []byte {
+	for len(b) >= 12 && bytes.HasPrefix(b, []byte("8BIM")) {
+		rid := binary.BigEndian.Uint16(b[4:6])
+		b = b[6:]
+		// name is a pascal string padded to even size
+		n := 1 + int(b[0])
+		n += n % 2
+		if n+4 > len(b) {
+			return nil
+		}
+		size := int(binary.BigEndian.Uint32(b[n : n+4]))
+		b = b[n+4:]
+		if size > len(b) {
+			return nil
+		}
+		if rid == id {
+			return b[:size]
+		}
+		size += size % 2
+		if size > len(b) {
+			return nil
+		}
+		b = b[size:]
+	}
+	return nil
+}
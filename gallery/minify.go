@@ -0,0 +1,120 @@
+package gallery
+
+import (
+	"bytes"
+	"regexp"
+)
+
+// minifyHTML removes comments and insignificant whitespace from html: text
+// whitespace is collapsed to a single space, and dropped altogether at the
+// start and end of text spanning multiple lines. Contents of style elements
+// are minified with minifyCSS; script, pre and textarea contents are kept as
+// is.
+func minifyHTML(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	for len(b) > 0 {
+		switch {
+		case bytes.HasPrefix(b, []byte("<!--")):
+			i := bytes.Index(b, []byte("-->"))
+			if i < 0 {
+				return append(out, b...)
+			}
+			b = b[i+3:]
+		case b[0] == '<':
+			n := tagLen(b)
+			tag := b[:n]
+			out, b = append(out, tag...), b[n:]
+			name := tagName(tag)
+			if !rawElements[name] {
+				continue
+			}
+			end := indexFold(b, "</"+name)
+			if end < 0 {
+				end = len(b)
+			}
+			if name == "style" {
+				out = append(out, minifyCSS(b[:end])...)
+			} else {
+				out = append(out, b[:end]...)
+			}
+			b = b[end:]
+		default:
+			i := bytes.IndexByte(b, '<')
+			if i < 0 {
+				i = len(b)
+			}
+			out = append(out, minifyText(b[:i])...)
+			b = b[i:]
+		}
+	}
+	return out
+}
+
+// rawElements are elements with contents minifyHTML must not treat as text
+var rawElements = map[string]bool{"script": true, "style": true, "pre": true, "textarea": true}
+
+// tagLen returns length of a tag b starts with, taking quoted attribute values
+// into account
+func tagLen(b []byte) int {
+	var quote byte
+	for i := 1; i < len(b); i++ {
+		switch c := b[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '>':
+			return i + 1
+		}
+	}
+	return len(b)
+}
+
+// tagName returns lowercase name of an opening tag, or an empty string if tag
+// is not an opening one
+func tagName(tag []byte) string {
+	i := 1
+	for i < len(tag) && (tag[i] >= 'a' && tag[i] <= 'z' || tag[i] >= 'A' && tag[i] <= 'Z' || tag[i] >= '0' && tag[i] <= '9') {
+		i++
+	}
+	return string(bytes.ToLower(tag[1:i]))
+}
+
+// indexFold is like bytes.Index, but matches s case-insensitively
+func indexFold(b []byte, s string) int {
+	sb := []byte(s)
+	for i := 0; i+len(sb) <= len(b); i++ {
+		if bytes.EqualFold(b[i:i+len(sb)], sb) {
+			return i
+		}
+	}
+	return -1
+}
+
+var (
+	spaceRe        = regexp.MustCompile(`\s+`)
+	leadingLineRe  = regexp.MustCompile(`^\s*\n\s*`)
+	trailingLineRe = regexp.MustCompile(`\s*\n\s*$`)
+)
+
+// minifyText collapses whitespace of text between tags
+func minifyText(b []byte) []byte {
+	b = leadingLineRe.ReplaceAll(b, nil)
+	b = trailingLineRe.ReplaceAll(b, nil)
+	return spaceRe.ReplaceAll(b, []byte(" "))
+}
+
+var (
+	cssCommentRe = regexp.MustCompile(`(?s)/\*.*?\*/`)
+	cssPunctRe   = regexp.MustCompile(`\s*([{};,])\s*`)
+)
+
+// minifyCSS removes comments and whitespace around punctuation from css
+func minifyCSS(b []byte) []byte {
+	b = cssCommentRe.ReplaceAll(b, nil)
+	b = spaceRe.ReplaceAll(b, []byte(" "))
+	b = cssPunctRe.ReplaceAll(b, []byte("$1"))
+	return bytes.TrimSpace(b)
+}
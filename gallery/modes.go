@@ -0,0 +1,49 @@
+package gallery
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// fileModes holds permissions set on created directories and files, zero
+// values mean default permissions limited by umask
+type fileModes struct {
+	Dir  os.FileMode
+	File os.FileMode
+}
+
+// mkdirAll is like os.MkdirAll, but sets Dir permissions on directories it
+// creates
+func (m fileModes) mkdirAll(dir string) error {
+	if m.Dir == 0 {
+		return os.MkdirAll(dir, 0777)
+	}
+	var created []string
+	for p := filepath.Clean(dir); ; p = filepath.Dir(p) {
+		if _, err := os.Stat(p); err == nil || !os.IsNotExist(err) {
+			break
+		}
+		created = append(created, p)
+		if p == filepath.Dir(p) {
+			break
+		}
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	for _, p := range created {
+		if err := os.Chmod(p, m.Dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chmod sets File permissions on created file name. It must not be called on
+// hard links to source files.
+func (m fileModes) chmod(name string) error {
+	if m.File == 0 {
+		return nil
+	}
+	return os.Chmod(name, m.File)
+}
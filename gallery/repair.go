@@ -0,0 +1,141 @@
+package gallery
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// Repair recreates missing thumbnails, medium and full size images of a
+// previously generated gallery described by args.Cache from their sources.
+// Source directories are not walked and sources are not hashed again, so
+// they are assumed to be unchanged since; args should have the same options
+// gallery was generated with. Images with sources no longer existing are
+// reported with args.Logf and skipped. It returns number of recreated files.
+func Repair(ctx context.Context, args Options) (int, error) {
+	if args.Cache == "" {
+		return 0, errors.New("metadata cache must be set to repair gallery")
+	}
+	if err := args.validate(); err != nil {
+		return 0, err
+	}
+	page, err := loadCache(args.cacheFile())
+	if err != nil {
+		return 0, err
+	}
+	thumbOpts, mediumOpts, err := args.thumbOptions()
+	if err != nil {
+		return 0, err
+	}
+	copyOpts := copyOptions{NoLink: args.Copy}
+	modes := fileModes{Dir: args.DirMode, File: args.FileMode}
+	root := filepath.Dir(args.HTML)
+	// missing returns name of file p relative to html file directory if
+	// it does not exist, or an empty string otherwise
+	missing := func(p string) (string, error) {
+		if p == "" {
+			return "", nil
+		}
+		name := filepath.Join(root, filepath.FromSlash(p))
+		_, err := os.Stat(name)
+		if os.IsNotExist(err) {
+			return name, nil
+		}
+		return "", err
+	}
+	var n int
+	for _, img := range page.Images {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		thumb, err := missing(img.Thumbnail)
+		if err != nil {
+			return n, err
+		}
+		medium, err := missing(img.Medium)
+		if err != nil {
+			return n, err
+		}
+		orig, err := missing(img.Original)
+		if err != nil {
+			return n, err
+		}
+		if thumb == "" && medium == "" && orig == "" {
+			continue
+		}
+		src := filepath.FromSlash(img.Source)
+		if page.RelativeSources && !filepath.IsAbs(src) {
+			src = filepath.Join(args.SrcDirs[0], src)
+		}
+		format, err := imageFormat(src)
+		if err == nil && format == "" {
+			err = errors.New("source is empty or not an image")
+		}
+		if err != nil {
+			args.event(EventSkipped, src, 0, "image %s: cannot repair: %v", img.ID(), err)
+			continue
+		}
+		// malformed metadata is not fatal, image itself may still be fine
+		meta, _ := readXMP(src)
+		if thumb != "" {
+			opts := thumbOpts
+			opts.Orientation = meta.Orientation
+			if opts.Focus, err = readFocus(src); err != nil {
+				return n, err
+			}
+			if err := repairThumbnail(ctx, opts, modes, thumb, src); err != nil {
+				return n, err
+			}
+			args.vevent(EventRecreated, thumb, 1, "image %s: recreated %s", img.ID(), thumb)
+			n++
+		}
+		if medium != "" {
+			if args.MediumMaxDim <= 0 {
+				args.event(EventSkipped, medium, 0, "image %s: cannot recreate %s without medium size set", img.ID(), medium)
+			} else {
+				opts := mediumOpts
+				opts.Orientation = meta.Orientation
+				if err := repairThumbnail(ctx, opts, modes, medium, src); err != nil {
+					return n, err
+				}
+				args.vevent(EventRecreated, medium, 1, "image %s: recreated %s", img.ID(), medium)
+				n++
+			}
+		}
+		if orig != "" {
+			if err := modes.mkdirAll(filepath.Dir(orig)); err != nil {
+				return n, err
+			}
+			mode := copyCopied
+			if format != formatJPEG || args.reorient(src, meta.Orientation) {
+				_, err = convertToJPEG(ctx, orig, src, meta.Orientation, thumbOpts.Background, args.SRGB)
+			} else {
+				mode, _, err = linkOrCopy(ctx, copyOpts, orig, src)
+			}
+			if err != nil {
+				return n, err
+			}
+			if mode == copyCopied {
+				if err := modes.chmod(orig); err != nil {
+					return n, err
+				}
+			}
+			args.vevent(EventRecreated, orig, 1, "image %s: recreated %s", img.ID(), orig)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// repairThumbnail creates missing thumbnail or medium size image dst from
+// image src, along with its directory
+func repairThumbnail(ctx context.Context, opts thumbOptions, modes fileModes, dst, src string) error {
+	if err := modes.mkdirAll(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	if _, err := createThumbnail(ctx, opts, dst, src); err != nil {
+		return err
+	}
+	return modes.chmod(dst)
+}
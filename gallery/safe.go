@@ -0,0 +1,63 @@
+package gallery
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// OutputMarker is a name of empty file written into output directories, so
+// that later runs with Options.Safe can tell them from directories holding
+// unrelated files
+const OutputMarker = ".photo-gallery"
+
+// checkOutputDirs returns an error if any of dirs is a non-empty directory
+// without OutputMarker. Directories that don't exist yet are fine.
+func checkOutputDirs(dirs []string) error {
+	for _, dir := range dirs {
+		if _, err := os.Stat(filepath.Join(dir, OutputMarker)); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		f, err := os.Open(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		_, err = f.Readdirnames(1)
+		f.Close()
+		switch {
+		case err == io.EOF:
+			continue
+		case err != nil:
+			return err
+		}
+		return fmt.Errorf("refusing to write into %s: it is not empty and has no %s file of a previous run", dir, OutputMarker)
+	}
+	return nil
+}
+
+// markOutputDirs creates OutputMarker in each of dirs that exist
+func markOutputDirs(dirs []string, modes fileModes) error {
+	for _, dir := range dirs {
+		name := filepath.Join(dir, OutputMarker)
+		if _, err := os.Stat(name); err == nil {
+			continue
+		}
+		if err := ioutil.WriteFile(name, nil, 0666); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		if err := modes.chmod(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,549 @@
+package gallery
+
+import "html/template"
+
+var defaultTemplate = template.Must(template.New("gallery").Parse(DefaultTemplate))
+
+// TemplateHeader is a template comment describing data available to gallery
+// templates. It is meant to be put before DefaultTemplate when it is written
+// out for customization, and renders to nothing.
+const TemplateHeader = `{{- /*
+Gallery template, see https://pkg.go.dev/html/template for syntax. No
+functions beyond the html/template builtins are available; the data passed
+to the template has these fields and methods:
+
+  .Name, .Footer, .URL    gallery name, footer text, public url of the page
+  .Description            optional gallery description
+  .Images                 images, newest first, each with fields:
+    .Thumbnail, .Width, .Height   thumbnail path and its size in pixels
+    .Original, .Medium            full size and optional medium image paths
+    .Display                      medium image path if set, full size otherwise
+    .Source, .Time, .Tags         source file, image time, XMP or IPTC keywords
+    .Title                        XMP title
+    .Camera, .Exposure            EXIF camera and lens, exposure settings
+    .Caption                      file name, time, camera and exposure line
+    .Featured                     whether image has a featured marker file
+    .New                          whether image was added during this run
+    .Rating, .Portrait, .Animated XMP rating, orientation, animated gif flag
+    .ID, .Permalink, .DownloadName, .TagsJSON
+    .Aspect, .Panorama            thumbnail aspect ratio, whether it is 2 or more
+  .ImageURL path          url of an image path, see -base-url
+  .ImageOrigin            origin of -base-url, if it is set
+  .AbsURL path            absolute url of a path relative to the page
+  .DateRange, .Summary    human readable date range and summary line
+  .Earliest, .Latest      times of the oldest and newest images
+  .Tags                   sorted set of all image tags
+  .FeaturedImages         images with .Featured set, shown above the grid;
+                          with .FeaturedApart set they are left out of it
+  .Grid                   images shown in the grid, newest first
+  .Lightboxes             images shown full size: featured ones left out of
+                          the grid, followed by .Grid
+  .SchemaJSON             schema.org metadata if .Schema is set
+  .Deferred               whether .Grid images after .Initial are loaded by
+                          script, as are .Lightboxes after .LightboxInitial
+  .MarkNew                whether images with .New set are to be marked
+  .Stacks                 whether bursts are stacked: images with .Stack hold
+                          the rest of a burst, those have .StackOf set to
+                          the ID of the image representing it
+  .CustomCSS, .StylesheetHref, .Favicon, .Eager, .GridMinWidth, .Layout,
+  .Spans, .Minify, .NoIndex, .Permalinks, .PasswordSalt, .PasswordHash
+
+The "password-gate" template defined at the end is also used by permalink
+pages, which are not affected by this file.
+*/ -}}
+`
+
+// DefaultTemplate is a body of the html/template used unless Options.Template
+// is set
+const DefaultTemplate = `<!DOCTYPE html><head><meta charset="utf-8">
+<title>{{.Name}}</title>
+<link rel="icon" href="{{with .Favicon}}{{.}}{{else}}data:image/svg+xml,%3Csvg xmlns='http://www.w3.org/2000/svg' viewBox='0 0 16 16'%3E%3Crect width='16' height='16' rx='3' fill='%23333'/%3E%3Ccircle cx='8' cy='8.5' r='4' fill='none' stroke='white' stroke-width='1.5'/%3E%3C/svg%3E{{end}}">
+<meta name="viewport" content="width=device-width, initial-scale=1">{{if .NoIndex}}
+<meta name="robots" content="noindex,nofollow">{{end}}
+<meta property="og:type" content="website">
+<meta property="og:title" content="{{.Name}}">
+<meta property="og:description" content="{{with .Description}}{{.}}{{else}}{{.Summary}}{{end}}">{{with .Description}}
+<meta name="description" content="{{.}}">{{end}}{{if .URL}}
+<meta property="og:url" content="{{.URL}}">{{if not .PasswordHash}}{{with index .Images 0}}
+<meta property="og:image" content="{{$.AbsURL ($.ImageURL .Thumbnail)}}">{{end}}{{end}}{{end}}
+<meta name="twitter:card" content="summary_large_image">{{with .ImageOrigin}}
+<link rel="preconnect" href="{{.}}">{{end}}{{if not .PasswordHash}}
+{{$max := .Eager}}{{$slen := len .Images}}{{if lt $slen $max}}{{$max = $slen}}{{end}}{{range slice .Images 0 $max}}
+<link rel="preload" as="image" type="image/jpeg" href="{{$.ImageURL .Thumbnail}}">{{end}}{{end}}{{if and .Schema (not .PasswordHash)}}
+<script type="application/ld+json">{{.SchemaJSON}}</script>{{end}}
+<script>
+	(function() {
+		var theme = localStorage.getItem("theme");
+		if (theme) { document.documentElement.dataset.theme = theme; }
+	})();
+</script>
+<style>
+	:root {
+		--background: whitesmoke;
+		--foreground: black;
+		--bar-background: black;
+		--bar-foreground: white;
+		--lightbox-background: rgba(0, 0, 0, 0.9);
+		color-scheme: light;
+	}
+	:root[data-theme="dark"] {
+		--background: #161616;
+		--foreground: #e8e8e8;
+		--bar-background: #2a2a2a;
+		--bar-foreground: #e8e8e8;
+		--lightbox-background: rgba(0, 0, 0, 0.95);
+		color-scheme: dark;
+	}
+	@media (prefers-color-scheme: dark) {
+		:root:not([data-theme="light"]) {
+			--background: #161616;
+			--foreground: #e8e8e8;
+			--bar-background: #2a2a2a;
+			--bar-foreground: #e8e8e8;
+			--lightbox-background: rgba(0, 0, 0, 0.95);
+			color-scheme: dark;
+		}
+	}
+	* {box-sizing: border-box; border: none; font-family: ui-sans-serif, sans-serif;}
+	html {background-color: var(--background); color: var(--foreground); padding:0;margin:0;}
+	body {padding:0;margin:0;}
+	header, footer {line-height: 1.7; padding: 5px; background-color: var(--bar-background); color: var(--bar-foreground);}
+	header {display: flex; align-items: center; justify-content: space-between;}
+	h1 {font-style: bold; font-size:x-large; margin:0;padding:0;}
+	.summary {font-size: small; margin:0;padding:0;}
+	footer {text-align: center;}
+	#theme-toggle {
+		display: none;
+		cursor: pointer;
+		padding: 0 0.5em;
+		font-size: large;
+		background: none;
+		color: inherit;
+	}
+	.gallery {
+		display: grid;
+		grid-template-columns: repeat(auto-fit, minmax({{.GridMinWidth}}px, 1fr));
+		grid-gap: 5px;
+		grid-auto-flow: row dense;
+
+		padding: 5px;
+		margin: auto;
+	}
+	.featured {
+		display: grid;
+		grid-template-columns: repeat(auto-fit, minmax(min(100%, calc({{.GridMinWidth}}px * 2)), 1fr));
+		grid-gap: 5px;
+		padding: 5px 5px 0 5px;
+	}
+	.featured img {
+		display: block;
+		object-fit: cover;
+		width: 100%;
+		height: 60vh;
+	}
+	.gallery.masonry {
+		display: block;
+		column-width: {{.GridMinWidth}}px;
+		column-gap: 5px;
+	}
+	.gallery.masonry figure {
+		break-inside: avoid;
+		margin-bottom: 5px;
+	}
+	.gallery.justified {
+		display: flex;
+		flex-wrap: wrap;
+		gap: 5px;
+	}
+	.gallery.justified::after {
+		content: "";
+		flex-grow: 1000000;
+	}
+	.gallery.justified figure {
+		flex-grow: calc(var(--aspect) * 100);
+		flex-basis: calc(var(--aspect) * {{.GridMinWidth}}px);
+	}
+	.gallery noscript {
+		display: contents;
+	}
+	#load-more {
+		display: none;
+		cursor: pointer;
+		margin: 5px auto;
+		padding: 2px 10px;
+		border-radius: 1em;
+		background-color: var(--bar-background);
+		color: var(--bar-foreground);
+	}
+	.gallery .portrait {
+		grid-row-end: span 2;
+	}{{if .Spans}}
+	@media (min-width: calc({{.GridMinWidth}}px * 2 + 15px)) {
+		.gallery .panorama {
+			grid-column-end: span 2;
+		}
+	}{{end}}
+	.gallery img {
+		display: block;
+		object-fit: cover;
+		width: 100%;
+		height: 100%;
+	}
+	.gallery.masonry img, .gallery.justified img {
+		height: auto;
+	}
+	figure {
+		padding: 0;
+		margin: 0;
+	}
+	.gallery figure {
+		position: relative;
+	}
+	.gallery .badge {
+		position: absolute;
+		top: 5px;
+		right: 5px;
+		padding: 0 5px;
+		font-size: small;
+		background-color: var(--bar-background);
+		color: var(--bar-foreground);
+		opacity: 0.8;
+	}
+	.gallery .badge.new {
+		right: auto;
+		left: 5px;
+	}
+	.gallery .stack-count {
+		display: none;
+		position: absolute;
+		top: 5px;
+		left: 5px;
+		cursor: pointer;
+		padding: 0 5px;
+		font-size: small;
+		background-color: var(--bar-background);
+		color: var(--bar-foreground);
+		opacity: 0.8;
+	}
+	.gallery.stacks .stack-count {
+		display: block;
+	}
+	.gallery.stacks [data-stack-of]:not(.open) {
+		display: none;
+	}
+	.tags {
+		display: none;
+		flex-wrap: wrap;
+		gap: 5px;
+		padding: 5px 5px 0 5px;
+	}
+	.tags button {
+		cursor: pointer;
+		padding: 2px 10px;
+		border-radius: 1em;
+		background-color: var(--bar-background);
+		color: var(--bar-foreground);
+		opacity: 0.6;
+	}
+	.tags button.active {
+		opacity: 1;
+	}
+	.lightbox {
+		display: none;
+	}
+	.lightbox:target {
+		z-index: 999;
+		outline: none;
+		display: block;
+		position: fixed;
+		top: 0;
+		left: 0;
+		width: 100%;
+		height: 100vh;
+		background-color: var(--lightbox-background);
+	}
+	.lightbox:target img {
+		object-fit: scale-down;
+		width: 100%;
+		height: 100%;
+	}
+	.lightbox .download {
+		position: absolute;
+		right: 10px;
+		bottom: 10px;
+		padding: 2px 10px;
+		background-color: var(--bar-background);
+		color: var(--bar-foreground);
+		opacity: 0.8;
+	}
+	.lightbox figcaption {
+		position: absolute;
+		left: 10px;
+		bottom: 10px;
+		max-width: 60%;
+		padding: 2px 10px;
+		background-color: var(--bar-background);
+		color: var(--bar-foreground);
+		opacity: 0.8;
+	}
+{{with .CustomCSS}}{{.}}
+{{end}}</style>{{with .StylesheetHref}}
+<link rel="stylesheet" href="{{.}}">{{end}}
+</head>
+<body>
+<header><div><h1>{{.Name}}</h1>
+<p class="summary">{{.Summary}}</p></div><button id="theme-toggle" type="button" title="Toggle dark theme">&#9680;</button></header>
+{{with .Tags}}<nav class="tags" id="tags">
+	<button type="button" class="active" data-tag="">all</button>{{range .}}
+	<button type="button" data-tag="{{.}}">{{.}}</button>{{end}}
+</nav>
+{{end}}{{with .FeaturedImages}}<section class="featured">{{range .}}
+	<figure><a href="{{if $.Permalinks}}{{.Permalink}}{{else}}#{{.ID}}{{end}}">
+	<img loading="eager" decoding="async" {{if $.PasswordHash}}data-src{{else}}src{{end}}="{{$.ImageURL .Display}}"{{with .Title}} alt="{{.}}"{{end}}>
+	</a></figure>{{end}}
+</section>
+{{end}}<main class="gallery {{.Layout}}">
+{{range $i, $img := .Grid}}{{if and $.Deferred (eq $i $.Initial)}}<noscript class="more">
+{{end}}
+	<figure{{if $img.Portrait}} class="portrait"{{else if and $.Spans $img.Panorama}} class="panorama"{{end}}{{with $img.StackOf}} data-stack-of="{{.}}"{{end}}{{if eq $.Layout "justified"}} style="--aspect: {{$img.Aspect}}"{{end}}{{if $img.Tags}} data-tags="{{$img.TagsJSON}}"{{end}}><a href="{{if $.Permalinks}}{{$img.Permalink}}{{else}}#{{$img.ID}}{{end}}">
+	<img {{if lt $i $.Eager}}loading="eager" fetchpriority="high"{{else}}loading="lazy"{{end}} decoding="async" {{with $img.Width}}width="{{.}}" height="{{$img.Height}}" {{end}}{{if $.PasswordHash}}data-src{{else}}src{{end}}="{{$.ImageURL $img.Thumbnail}}"{{with $img.Title}} alt="{{.}}"{{end}}>{{if $img.Animated}}
+	<span class="badge">GIF</span>{{end}}{{if and $.MarkNew $img.New}}
+	<span class="badge new">new</span>{{end}}
+	</a>{{with $img.Stack}}
+	<button class="stack-count" type="button" data-stack="{{$img.ID}}" title="show burst">+{{len .}}</button>{{end}}
+	</figure>
+{{end}}{{if .Deferred}}</noscript>
+{{end}}</main>{{if .Deferred}}
+<button id="load-more" type="button">load more</button>{{end}}
+<div class="fullsize-images">
+{{range $i, $img := .Lightboxes}}{{if and $.Deferred (eq $i $.LightboxInitial)}}<noscript class="more">
+{{end}}
+	<figure class="lightbox" id="{{.ID}}">
+		<a href="#back">
+		<img loading="lazy" decoding="async" {{if $.PasswordHash}}data-src{{else}}src{{end}}="{{$.ImageURL .Display}}"{{with .Title}} alt="{{.}}"{{end}}>
+		</a>{{with .Caption}}
+		<figcaption>{{.}}</figcaption>{{end}}{{if .Medium}}
+		<a class="download" href="{{$.ImageURL .Original}}" download="{{.DownloadName}}">download original</a>{{end}}
+	</figure>
+{{end}}{{if .Deferred}}</noscript>
+{{end}}</div>
+<footer>{{with .Footer}}{{.}}{{else}}&copy; all rights reserved{{end}}</footer>
+<script>
+	(function() {
+		var button = document.getElementById("theme-toggle");
+		var root = document.documentElement;
+		button.style.display = "inline-block";
+		button.addEventListener("click", function() {
+			var dark = root.dataset.theme ? root.dataset.theme === "dark" :
+				window.matchMedia("(prefers-color-scheme: dark)").matches;
+			root.dataset.theme = dark ? "light" : "dark";
+			localStorage.setItem("theme", root.dataset.theme);
+		});
+	})();
+	(function() {
+		var bar = document.getElementById("tags");
+		if (!bar) { return; }
+		var buttons = bar.querySelectorAll("button");
+		bar.style.display = "flex";
+		bar.addEventListener("click", function(e) {
+			var tag = e.target.dataset.tag;
+			if (tag === undefined) { return; }
+			buttons.forEach(function(b) { b.classList.toggle("active", b === e.target); });
+			document.querySelectorAll(".gallery figure").forEach(function(f) {
+				var tags = f.dataset.tags ? JSON.parse(f.dataset.tags) : [];
+				f.style.display = (tag === "" || tags.indexOf(tag) !== -1) ? "" : "none";
+			});
+		});
+	})();{{if .Stacks}}
+	(function() {
+		var gallery = document.querySelector(".gallery");
+		gallery.classList.add("stacks");
+		gallery.addEventListener("click", function(e) {
+			var id = e.target.dataset.stack;
+			if (id === undefined) { return; }
+			document.querySelectorAll('.gallery [data-stack-of="' + id + '"]').forEach(function(f) {
+				f.classList.toggle("open");
+			});
+		});
+	})();{{end}}{{if .Deferred}}
+	(function() {
+		// images past the initial ones are kept as markup of noscript
+		// elements, which is plain text when scripts are enabled
+		function parse(el) {
+			var t = document.createElement("template");
+			t.innerHTML = el.textContent;
+			return Array.prototype.slice.call(t.content.children);
+		}
+		var more = document.querySelectorAll("noscript.more");
+		var figures = parse(more[0]), lightboxes = parse(more[1]);
+		var gallery = document.querySelector(".gallery");
+		var fullsize = document.querySelector(".fullsize-images");
+		var button = document.getElementById("load-more");
+		var observer = new IntersectionObserver(function(entries) {
+			if (entries[0].isIntersecting) { load({{.Initial}}); }
+		});
+		function load(n) {
+			figures.splice(0, n).forEach(function(f) { gallery.appendChild(f); });
+			lightboxes.splice(0, n).forEach(function(f) { fullsize.appendChild(f); });
+			if (document.documentElement.dataset.revealed) {
+				document.querySelectorAll("[data-src]:not([src])").forEach(function(el) { el.src = el.dataset.src; });
+			}
+			var active = document.querySelector("#tags button.active");
+			if (active) { active.click(); }
+			if (figures.length === 0) {
+				observer.disconnect();
+				button.remove();
+			}
+		}
+		button.style.display = "block";
+		button.addEventListener("click", function() { load({{.Initial}}); });
+		observer.observe(button);
+		if (location.hash && !document.getElementById(location.hash.slice(1))) { load(figures.length); }
+	})();{{end}}
+</script>
+{{template "password-gate" .}}
+</body>
+` + passwordGateTemplate
+
+var permalinkTemplate = template.Must(template.New("permalink").Parse(permalinkTemplateBody))
+
+// permalinkTemplateBody is a template used for per-image pages; image paths
+// are relative to gallery html file, so they're prefixed with "../"
+const permalinkTemplateBody = `<!DOCTYPE html><head><meta charset="utf-8">
+<title>{{.Gallery.Name}}</title>
+<link rel="icon" href="{{with .Gallery.Favicon}}{{.}}{{else}}data:image/svg+xml,%3Csvg xmlns='http://www.w3.org/2000/svg' viewBox='0 0 16 16'%3E%3Crect width='16' height='16' rx='3' fill='%23333'/%3E%3Ccircle cx='8' cy='8.5' r='4' fill='none' stroke='white' stroke-width='1.5'/%3E%3C/svg%3E{{end}}">
+<meta name="viewport" content="width=device-width, initial-scale=1">{{if .Gallery.NoIndex}}
+<meta name="robots" content="noindex,nofollow">{{end}}
+<meta property="og:type" content="website">
+<meta property="og:title" content="{{.Gallery.Name}}">
+<meta property="og:description" content="{{.Image.Time.Format "2 January 2006"}}">{{if .Gallery.URL}}
+<meta property="og:url" content="{{.Gallery.AbsURL .Image.Permalink}}">{{if not .Gallery.PasswordHash}}
+<meta property="og:image" content="{{.Gallery.AbsURL (.Gallery.ImageURL .Image.Thumbnail)}}">{{end}}{{end}}
+<meta name="twitter:card" content="summary_large_image">
+<script>
+	(function() {
+		var theme = localStorage.getItem("theme");
+		if (theme) { document.documentElement.dataset.theme = theme; }
+	})();
+</script>
+<style>
+	:root {
+		--background: whitesmoke;
+		--foreground: black;
+		--bar-background: black;
+		--bar-foreground: white;
+		color-scheme: light;
+	}
+	:root[data-theme="dark"] {
+		--background: #161616;
+		--foreground: #e8e8e8;
+		--bar-background: #2a2a2a;
+		--bar-foreground: #e8e8e8;
+		color-scheme: dark;
+	}
+	@media (prefers-color-scheme: dark) {
+		:root:not([data-theme="light"]) {
+			--background: #161616;
+			--foreground: #e8e8e8;
+			--bar-background: #2a2a2a;
+			--bar-foreground: #e8e8e8;
+			color-scheme: dark;
+		}
+	}
+	* {box-sizing: border-box; border: none; font-family: ui-sans-serif, sans-serif;}
+	html {background-color: var(--background); color: var(--foreground); padding:0;margin:0;}
+	body {padding:0;margin:0; display: flex; flex-direction: column; min-height: 100vh;}
+	header, footer, nav {line-height: 1.7; padding: 5px; background-color: var(--bar-background); color: var(--bar-foreground);}
+	a {color: inherit;}
+	h1 {font-style: bold; font-size:x-large; margin:0;padding:0;}
+	nav {display: flex; justify-content: space-between;}
+	footer {text-align: center;}
+	main {flex: 1; display: flex; flex-direction: column; align-items: center; padding: 5px;}
+	main img {display: block; max-width: 100%; max-height: 85vh; object-fit: scale-down;}
+	main p {margin: 5px 0;}
+{{with .Gallery.CustomCSS}}{{.}}
+{{end}}</style>{{with .Gallery.StylesheetHref}}
+<link rel="stylesheet" href="{{.}}">{{end}}
+</head>
+<body>
+<header><h1><a href="../{{.Index}}#{{.Image.ID}}">{{.Gallery.Name}}</a></h1></header>
+<nav>
+	<span>{{with .Prev}}<a href="{{.ID}}.html" rel="prev">&larr; newer</a>{{end}}</span>
+	<span>{{with .Next}}<a href="{{.ID}}.html" rel="next">older &rarr;</a>{{end}}</span>
+</nav>
+<main>
+	{{if .Gallery.PasswordHash}}<img decoding="async" data-src="{{.ImageURL .Image.Display}}">{{else}}<a href="{{.ImageURL .Image.Original}}" download="{{.Image.DownloadName}}"><img decoding="async" src="{{.ImageURL .Image.Display}}"></a>{{end}}
+	<p><time datetime="{{.Image.Time.Format "2006-01-02T15:04:05Z07:00"}}">{{.Image.Time.Format "2 January 2006 15:04"}}</time></p>{{with .Image.Camera}}
+	<p>{{.}}</p>{{end}}{{with .Image.Exposure}}
+	<p>{{.}}</p>{{end}}
+</main>
+<footer>{{with .Gallery.Footer}}{{.}}{{else}}&copy; all rights reserved{{end}}</footer>
+{{template "password-gate" .Gallery}}
+</body>
+` + passwordGateTemplate
+
+// passwordGateTemplate defines "password-gate" template, which is executed
+// with *galleryCache. If gallery is password-protected, it renders a script
+// asking for a password and, if its salted hash matches, copying data-src
+// attributes of all elements to their src attributes.
+//
+// This is obfuscation, not access control: image urls are still in the page
+// source. Hash is computed by inline code rather than crypto.subtle, which
+// browsers only provide on https pages.
+const passwordGateTemplate = `{{define "password-gate"}}{{if .PasswordHash}}<script>
+	(function() {
+		var salt = "{{.PasswordSalt}}", want = "{{.PasswordHash}}", key = "gallery-password";
+		function reveal() {
+			document.documentElement.dataset.revealed = "true";
+			document.querySelectorAll("[data-src]").forEach(function(el) { el.src = el.dataset.src; });
+		}
+		// SHA-256 of bytes as hex string; crypto.subtle is only available
+		// on https pages, this works on plain http too
+		function sha256(bytes) {
+			function rotr(x, n) { return (x >>> n) | (x << (32 - n)); }
+			// fractional parts of square and cube roots of the first primes
+			var h = [], k = [], i, j;
+			for (var n = 2; k.length < 64; n++) {
+				for (j = 2; j * j <= n && n % j; j++) {}
+				if (j * j > n) {
+					if (h.length < 8) { h.push(Math.pow(n, 1 / 2) * 4294967296 | 0); }
+					k.push(Math.pow(n, 1 / 3) * 4294967296 | 0);
+				}
+			}
+			var l = bytes.length, words = [], size = ((l + 8) >> 6 << 4) + 16;
+			for (i = 0; i < l; i++) { words[i >> 2] |= bytes[i] << (24 - i % 4 * 8); }
+			words[l >> 2] |= 0x80 << (24 - l % 4 * 8);
+			words[size - 1] = l * 8;
+			for (i = 0; i < size; i++) { words[i] |= 0; }
+			for (i = 0; i < size; i += 16) {
+				var w = words.slice(i, i + 16), a = h.slice();
+				for (j = 0; j < 64; j++) {
+					if (j >= 16) {
+						var x = w[j - 15], y = w[j - 2];
+						w[j] = (w[j - 16] + (rotr(x, 7) ^ rotr(x, 18) ^ x >>> 3) + w[j - 7] + (rotr(y, 17) ^ rotr(y, 19) ^ y >>> 10)) | 0;
+					}
+					var e = a[4];
+					var t1 = a[7] + (rotr(e, 6) ^ rotr(e, 11) ^ rotr(e, 25)) + (e & a[5] ^ ~e & a[6]) + k[j] + w[j];
+					var t2 = (rotr(a[0], 2) ^ rotr(a[0], 13) ^ rotr(a[0], 22)) + (a[0] & a[1] ^ a[0] & a[2] ^ a[1] & a[2]);
+					a.pop();
+					a.unshift((t1 + t2) | 0);
+					a[4] = (a[4] + t1) | 0;
+				}
+				for (j = 0; j < 8; j++) { h[j] = (h[j] + a[j]) | 0; }
+			}
+			return h.map(function(v) { return (v >>> 0).toString(16).padStart(8, "0"); }).join("");
+		}
+		function ask(password) {
+			while (password !== null) {
+				if (sha256(new TextEncoder().encode(salt + password)) === want) {
+					sessionStorage.setItem(key, password);
+					reveal();
+					return;
+				}
+				password = prompt("Wrong password, try again:");
+			}
+		}
+		var saved = sessionStorage.getItem(key);
+		ask(saved !== null ? saved : prompt("This gallery is password-protected. Password:"));
+	})();
+</script>{{end}}{{end}}`
@@ -0,0 +1,66 @@
+package gallery
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeferredFeaturedApart(t *testing.T) {
+	const initial = 2
+	table := []struct {
+		name     string
+		featured []int // indexes of featured images
+		deferred int   // number of deferred grid images, 0 if none are
+	}{
+		{"no featured", nil, 3},
+		{"featured at initial", []int{initial}, 2},
+		{"featured before and at initial", []int{0, initial}, 1},
+		{"featured after initial", []int{4}, 2},
+		{"grid no longer than initial", []int{0, 1, 2}, 0},
+	}
+	for _, tc := range table {
+		page := &galleryCache{Name: "test", FeaturedApart: true, Initial: initial, Layout: LayoutGrid}
+		for i := 0; i < 5; i++ {
+			page.Images = append(page.Images, Image{
+				Source:    "img.jpg",
+				Hash:      uint64(i + 1),
+				Time:      time.Date(2024, 1, 5-i, 0, 0, 0, 0, time.UTC),
+				Thumbnail: "t/img.jpg",
+				Original:  "o/img.jpg",
+			})
+		}
+		for _, i := range tc.featured {
+			page.Images[i].Featured = true
+		}
+		page.setGrid()
+		var buf bytes.Buffer
+		if err := defaultTemplate.Execute(&buf, page); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		out := buf.String()
+		opened, closed := strings.Count(out, `<noscript class="more">`), strings.Count(out, "</noscript>")
+		if opened != closed {
+			t.Errorf("%s: %d noscript elements opened, %d closed", tc.name, opened, closed)
+			continue
+		}
+		if tc.deferred == 0 {
+			if opened != 0 {
+				t.Errorf("%s: got %d noscript elements, want none", tc.name, opened)
+			}
+			continue
+		}
+		if opened != 2 {
+			t.Errorf("%s: got %d noscript elements, want one for grid and one for lightboxes", tc.name, opened)
+			continue
+		}
+		// deferred grid images and their lightboxes
+		for i, part := range strings.Split(out, `<noscript class="more">`)[1:] {
+			part = part[:strings.Index(part, "</noscript>")]
+			if got := strings.Count(part, "<figure"); got != tc.deferred {
+				t.Errorf("%s: noscript #%d holds %d images, want %d", tc.name, i+1, got, tc.deferred)
+			}
+		}
+	}
+}
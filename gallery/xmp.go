@@ -0,0 +1,176 @@
+package gallery
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// xmpMeta holds image metadata read from XMP packet
+type xmpMeta struct {
+	Rating      int      // xmp:Rating, -1 for rejected images, 0 if not rated
+	Keywords    []string // dc:subject
+	Title       string   // dc:title, default language version
+	Orientation int      // tiff:Orientation, 1 to 8, or 0 if not set
+
+	rated bool // whether Rating is set
+}
+
+// override returns m with properties set in o replaced
+func (m xmpMeta) override(o xmpMeta) xmpMeta {
+	if o.rated {
+		m.Rating, m.rated = o.Rating, true
+	}
+	if len(o.Keywords) != 0 {
+		m.Keywords = o.Keywords
+	}
+	if o.Title != "" {
+		m.Title = o.Title
+	}
+	if o.Orientation != 0 {
+		m.Orientation = o.Orientation
+	}
+	return m
+}
+
+const (
+	xmpNamespace  = "http://ns.adobe.com/xap/1.0/"
+	xmpJPEGMark   = xmpNamespace + "\x00" // prefix of jpeg APP1 segment payload
+	dcNamespace   = "http://purl.org/dc/elements/1.1/"
+	tiffNamespace = "http://ns.adobe.com/tiff/1.0/"
+)
+
+// readXMP returns metadata from XMP packet stored in jpeg file, with
+// properties set in its sidecar file overriding embedded ones, see
+// readSidecar. It returns zero value without error if there is no XMP
+// metadata. Sidecar is used even if embedded metadata is malformed, in which
+// case an error is returned along with it.
+func readXMP(name string) (xmpMeta, error) {
+	meta, err := readEmbeddedXMP(name)
+	sidecar, err2 := readSidecar(name)
+	if err == nil {
+		err = err2
+	}
+	return meta.override(sidecar), err
+}
+
+// readEmbeddedXMP returns metadata from XMP packet stored in jpeg file. It
+// returns zero value without error if file has no XMP metadata.
+func readEmbeddedXMP(name string) (xmpMeta, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return xmpMeta{}, err
+	}
+	defer f.Close()
+	b, err := jpegSegment(bufio.NewReader(f), 0xE1, []byte(xmpJPEGMark))
+	if err != nil || b == nil {
+		return xmpMeta{}, err
+	}
+	return parseXMP(b)
+}
+
+// readSidecar returns metadata from XMP sidecar file of image name: either
+// name with .xmp suffix added, like photo.jpg.xmp, or with its extension
+// replaced, like photo.xmp. It returns zero value without error if there is
+// no sidecar.
+func readSidecar(name string) (xmpMeta, error) {
+	for _, s := range []string{name + ".xmp", strings.TrimSuffix(name, filepath.Ext(name)) + ".xmp"} {
+		b, err := ioutil.ReadFile(s)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return xmpMeta{}, err
+		}
+		return parseXMP(b)
+	}
+	return xmpMeta{}, nil
+}
+
+// parseXMP extracts metadata from XMP packet. Simple properties may be stored
+// either as attributes of rdf:Description element or as its child elements,
+// both forms are supported.
+func parseXMP(b []byte) (xmpMeta, error) {
+	var meta xmpMeta
+	dec := xml.NewDecoder(bytes.NewReader(b))
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return meta, nil
+		}
+		if err != nil {
+			return meta, err
+		}
+		el, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		for _, attr := range el.Attr {
+			meta.set(attr.Name, attr.Value)
+		}
+		switch el.Name {
+		case xml.Name{Space: xmpNamespace, Local: "Rating"}, xml.Name{Space: tiffNamespace, Local: "Orientation"}:
+			var s string
+			if err := dec.DecodeElement(&s, &el); err != nil {
+				return meta, err
+			}
+			meta.set(el.Name, s)
+		case xml.Name{Space: dcNamespace, Local: "subject"}:
+			var v struct {
+				Items []string `xml:"Bag>li"`
+			}
+			if err := dec.DecodeElement(&v, &el); err != nil {
+				return meta, err
+			}
+			for _, s := range v.Items {
+				if s = strings.TrimSpace(s); s != "" {
+					meta.Keywords = append(meta.Keywords, s)
+				}
+			}
+		case xml.Name{Space: dcNamespace, Local: "title"}:
+			var v struct {
+				Items []struct {
+					Lang  string `xml:"lang,attr"`
+					Value string `xml:",chardata"`
+				} `xml:"Alt>li"`
+			}
+			if err := dec.DecodeElement(&v, &el); err != nil {
+				return meta, err
+			}
+			for i, item := range v.Items {
+				if i == 0 || item.Lang == "x-default" {
+					meta.Title = strings.TrimSpace(item.Value)
+				}
+			}
+		}
+	}
+}
+
+// set assigns simple property value s, ignoring unknown properties
+func (m *xmpMeta) set(name xml.Name, s string) {
+	switch name {
+	case xml.Name{Space: xmpNamespace, Local: "Rating"}:
+		m.Rating, m.rated = xmpRating(s), true
+	case xml.Name{Space: tiffNamespace, Local: "Orientation"}:
+		if o, err := strconv.Atoi(strings.TrimSpace(s)); err == nil && o >= 1 && o <= 8 {
+			m.Orientation = o
+		}
+	}
+}
+
+// xmpRating parses xmp:Rating value, which is a real number in -1..5 range;
+// fractional ratings are rounded down
+func xmpRating(s string) int {
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return 0
+	}
+	return int(math.Floor(math.Max(-1, math.Min(5, f))))
+}
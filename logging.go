@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"github.com/artyom/photo-gallery/gallery"
+)
+
+// logJSON makes events logged as JSON records, one per line, instead of
+// human-readable text, see -log-json
+var logJSON bool
+
+// fields are event details logged with logEvent
+type fields map[string]interface{}
+
+// logEvent logs event of a given type. With logJSON set, it is written as a
+// JSON object with "event" and "time" keys added to f, otherwise text is
+// written as is.
+func logEvent(event string, f fields, text string) {
+	if !logJSON {
+		log.Print(text)
+		return
+	}
+	rec := make(fields, len(f)+2)
+	for k, v := range f {
+		rec[k] = v
+	}
+	rec["event"] = event
+	rec["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	b, err := json.Marshal(rec)
+	if err != nil {
+		log.Print(text)
+		return
+	}
+	log.Print(string(b))
+}
+
+// logGalleryEvent logs event reported by the gallery package; its file and
+// count are logged as "file" and "count" keys if set
+func logGalleryEvent(e gallery.Event) {
+	f := fields{"message": e.Text}
+	if e.File != "" {
+		f["file"] = e.File
+	}
+	if e.Count != 0 {
+		f["count"] = e.Count
+	}
+	logEvent(e.Type, f, e.Text)
+}
+
+// fatal logs err and exits with non-zero status
+func fatal(err error) {
+	logEvent("error", fields{"error": err.Error()}, err.Error())
+	os.Exit(1)
+}
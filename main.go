@@ -1,741 +1,455 @@
 // Command photo-gallery is a simple web photo gallery generator.
 //
-// It takes a directory with jpeg images (.jpg or .jpeg suffixes) and produces
-// HTML file along with two directories: one holds full-sized copies of
-// original photos, another contains thumbnails. These directories + an HTML
-// file are compatible with any web server supporting static content.
+// It takes a directory with jpeg images (.jpg, .jpeg or .jpe suffixes) and
+// produces HTML file along with two directories: one holds full-sized copies of
+// original photos, another contains thumbnails. TIFF and GIF images (.tif,
+// .tiff, .gif suffixes) are also supported, their full-sized copies are
+// converted to jpeg; only the first frame of animated GIF is used.
+// These directories + an HTML file are compatible with any web server
+// supporting static content. With -sniff flag, files with other or no suffixes
+// are used too if their content is of one of these formats; camera raw files,
+// like .nef or .dng, are not.
+//
+// Directories containing a .nomedia file are skipped. A .galleryignore file
+// lists glob patterns, one per line, of files and directories to skip within
+// its directory and subdirectories.
+//
+// An image with a marker file named after it with .hidden suffix added,
+// like photo.jpg.hidden, still gets its thumbnail and full size copy, but is
+// left out of the gallery page. Images with .featured marker files, like
+// photo.jpg.featured, are shown large above the grid.
+//
+// Rating, keywords, title and orientation are read from XMP metadata, with
+// values from a sidecar file, photo.jpg.xmp or photo.xmp, taking precedence
+// over ones embedded into the image.
+//
+// With -thumb-square, thumbnails are cropped around a focal point if it is
+// set in photo.jpg.focus or photo.focus file as two numbers from 0 to 1,
+// horizontal and vertical position, like "0.5 0.33".
+//
+// Gallery name, footer, description, url and base url can be kept in
+// gallery.json file in the first source directory, a JSON object with Name,
+// Footer, Description, URL and BaseURL keys; flags take precedence over it.
 //
 // The default template produces a self-contained gallery using only HTML and
-// CSS.
+// CSS. To customize it, write it to a file with -extract-template, edit
+// it and pass it with -template.
+//
+// Generation itself is implemented by the gallery package, which can be used
+// to embed the generator into other programs.
 package main
 
 import (
 	"bytes"
 	"context"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"hash/fnv"
-	"html/template"
-	"image"
-	"image/jpeg"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
-	"sort"
+	"runtime/debug"
+	"strconv"
 	"strings"
-	"sync"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
-	"github.com/artyom/phash"
-	"github.com/disintegration/imaging"
-	"github.com/rwcarlsen/goexif/exif"
-	"github.com/rwcarlsen/goexif/tiff"
-	"golang.org/x/sync/errgroup"
+	"github.com/artyom/photo-gallery/gallery"
 )
 
 func main() {
 	log.SetFlags(0)
-	args := runArgs{
+	args := gallery.Options{
 		FullsizeDir: filepath.FromSlash("gallery/fullsize"),
 		HTML:        filepath.FromSlash("gallery/index.html"),
 		ThumbsDir:   filepath.FromSlash("gallery/thumbnails"),
+		ContactCols: 6,
+		Eager:       6,
 	}
-	flag.StringVar(&args.SrcDir, "src", args.SrcDir, "`directory` with source jpeg images")
+	flag.Var((*stringList)(&args.SrcDirs), "src", "`directory` with source jpeg, tiff or gif images;"+
+		" can be repeated, directories are walked in the given order")
 	flag.StringVar(&args.FullsizeDir, "orig", args.FullsizeDir, "`directory` to store full size image copies"+
 		" (hardlinked from the source if possible)")
 	flag.StringVar(&args.ThumbsDir, "thumb", args.ThumbsDir, "`directory` to store thumbnails")
 	flag.StringVar(&args.HTML, "html", args.HTML, "generated gallery html `file`")
 	flag.StringVar(&args.Template, "template", args.Template, "template `file` to use instead of default")
 	flag.StringVar(&args.Name, "name", args.Name, "optional gallery name")
-	flag.StringVar(&args.Cache, "cache", args.Cache, "optional metadata cache `file`, enables incremental gallery update")
-	flag.BoolVar(&args.Phash, "phash", args.Phash, "use perceptual hash to detect duplicates on add (slow)")
-
-	var dump bool
+	flag.StringVar(&args.Footer, "footer", args.Footer, "optional footer `text`, replaces default copyright notice")
+	flag.StringVar(&args.Description, "description", args.Description, "optional gallery description `text`"+
+		" for search engines and link previews, replaces summary of images")
+	flag.StringVar(&args.CSS, "css", args.CSS, "optional css `file` to inline after default styles")
+	flag.StringVar(&args.CSSHref, "css-href", args.CSSHref, "optional stylesheet `url` to link after default styles")
+	flag.StringVar(&args.Favicon, "favicon", args.Favicon, "optional icon `file` (svg, png or ico) to inline"+
+		" instead of default one")
+	flag.StringVar(&args.URL, "url", args.URL, "optional public `url` of the gallery html file,"+
+		" used for absolute links in social sharing meta tags")
+	flag.StringVar(&args.BaseURL, "base-url", args.BaseURL, "optional `url` to load images from instead of"+
+		" paths relative to html file, for images served from another origin like a CDN; it must point to"+
+		" html file directory counterpart there")
+	flag.StringVar(&args.Password, "password", args.Password, "optional `password` the page asks for before"+
+		" showing images; this is obfuscation, not access control: image urls are still in the page source,"+
+		" it only hides images from casual visitors")
+	flag.StringVar(&args.Cache, "cache", args.Cache, "optional metadata cache `file`, enables incremental gallery update;"+
+		" a bare file name is resolved relative to -html file directory, use ./name for current directory")
+	flag.StringVar(&args.TimeFrom, "time-from", args.TimeFrom, "image time `source`: "+
+		strings.Join(gallery.TimeSources, ", ")+" (default "+gallery.TimeFromExifOrMtime+", or value stored in cache)")
+	flag.StringVar(&args.TZ, "tz", args.TZ, "IANA time `zone` to assume for image times without explicit offset"+
+		" and to present times in (default local zone for parsing, UTC for output)")
+	flag.StringVar(&args.Since, "since", args.Since, "skip images taken before this `time`, in RFC3339"+
+		" or 2006-01-02 format (dates are in -tz zone)")
+	flag.StringVar(&args.Until, "until", args.Until, "skip images taken after this `time`, in RFC3339"+
+		" or 2006-01-02 format (dates are in -tz zone and include the whole day)")
+	flag.StringVar(&args.Hash, "hash", args.Hash, "hash `function` used to detect duplicates and name files: "+
+		strings.Join(gallery.HashFuncs, ", ")+" (default "+gallery.HashFNV+", or value stored in cache)")
+	flag.BoolVar(&args.Phash, "phash", args.Phash, "use perceptual hash to detect duplicates on add (slow),"+
+		" same as -hash="+gallery.HashPhash)
+	flag.IntVar(&args.MinRating, "min-rating", args.MinRating, "if not zero, skip images with XMP star rating below"+
+		" this `value` (unrated images have rating 0, rejected ones -1)")
+	flag.StringVar(&args.Bundle, "bundle", args.Bundle, "write html file, thumbnails and full size images into"+
+		" this zip `file` instead (paths in archive are relative to html file directory); gallery is staged"+
+		" in a temporary directory next to it, which may need as much disk space as the archive")
+	flag.BoolVar(&args.PhashRotations, "phash-rotations", args.PhashRotations, "with perceptual hash, also detect"+
+		" duplicates rotated by 90, 180 or 270 degrees (4 times slower)")
+	flag.BoolVar(&args.DedupeBrackets, "dedupe-brackets", args.DedupeBrackets, "with perceptual hash, keep only"+
+		" the middle exposure frame of exposure bracketing sets instead of failing on them as duplicates")
+	flag.StringVar(&args.Clusters, "clusters", args.Clusters, "with perceptual hash, add similar images instead of"+
+		" failing on them as possible duplicates, and write their sources to this `file` in groups for review")
+	flag.BoolVar(&args.Stacks, "stacks", args.Stacks, "with perceptual hash, show bursts of similar images taken"+
+		" within seconds of each other as a single thumbnail expanding on click, instead of failing on them as"+
+		" possible duplicates")
+	flag.BoolVar(&args.Safe, "safe", args.Safe, "refuse to write into non-empty output directories without "+
+		gallery.OutputMarker+" file, which is left there by every run")
+	flag.BoolVar(&args.Sniff, "sniff", args.Sniff, "also use source files with unknown or no extension that are"+
+		" jpeg, tiff or gif images judging by their content, except camera raw files")
+	flag.StringVar(&args.Checksums, "checksums", args.Checksums, "optional `file` to write SHA-256 checksums of"+
+		" thumbnails and full size images to, in sha256sum format with paths relative to html file directory")
+	flag.Var((*octalMode)(&args.DirMode), "dir-mode", "octal `permissions` of created directories"+
+		" (default 0777 limited by umask)")
+	flag.Var((*octalMode)(&args.FileMode), "file-mode", "octal `permissions` of created files"+
+		" (default 0666 limited by umask)")
+	flag.StringVar(&args.ContactSheet, "contact-sheet", args.ContactSheet, "optional jpeg `file` to write"+
+		" a contact sheet (all thumbnails on a single image) to; large ones are split into file-2.jpg, file-3.jpg, etc.")
+	flag.IntVar(&args.ContactCols, "contact-cols", args.ContactCols, "number of `columns` on a contact sheet")
+	flag.StringVar(&args.Filter, "filter", args.Filter, "thumbnail resampling `filter`, from the fastest"+
+		" to the highest quality: "+strings.Join(gallery.FilterNames, ", ")+" (default "+gallery.DefaultFilter+")")
+	flag.Float64Var(&args.Sharpen, "sharpen", gallery.DefaultSharpen, "`sigma` of sharpening applied to thumbnails"+
+		" and medium size images after downscaling, 0 disables it")
+	flag.IntVar(&args.MaxDestPixels, "max-dest-pixels", gallery.DefaultMaxDestPixels, "maximum number of `pixels`"+
+		" of created thumbnails and medium size images, larger settings are rejected")
+	flag.IntVar(&args.MediumMaxDim, "medium-maxdim", args.MediumMaxDim, "if positive, create medium size images"+
+		" no larger than this many `pixels` on either side and show them instead of full size ones, which are"+
+		" still available for download")
+	flag.BoolVar(&args.SRGB, "srgb", args.SRGB, "convert colors of jpeg images with embedded color profile, like Adobe"+
+		" RGB or Display P3, to sRGB in thumbnails and re-encoded copies; images without profile are assumed to be sRGB")
+	flag.BoolVar(&args.ThumbSquare, "thumb-square", args.ThumbSquare, "crop thumbnails to squares around image center")
+	flag.StringVar(&args.ThumbBackground, "thumb-bg", args.ThumbBackground, "`color` in #rrggbb notation to fill"+
+		" transparent areas of images converted to jpeg with (default white)")
+	flag.BoolVar(&args.EmbeddedThumbs, "use-embedded-thumbnail", args.EmbeddedThumbs, "make thumbnails of jpeg"+
+		" images from thumbnails embedded into their EXIF when those are large enough (faster, lower quality)")
+	flag.BoolVar(&args.ForceThumbs, "force-thumbs", args.ForceThumbs, "regenerate thumbnails even if they already exist"+
+		" (use after changing thumbnail settings)")
+	flag.BoolVar(&args.Copy, "copy", args.Copy, "always copy full size images, never hardlink them to sources"+
+		" (existing hardlinks are replaced with copies)")
+	flag.Int64Var(&args.MaxOutputBytes, "max-output-bytes", args.MaxOutputBytes, "if positive, limit total size"+
+		" of thumbnails and full size images to this many `bytes`, omitting the oldest images that don't fit")
+	flag.BoolVar(&args.OrientOriginals, "orient-originals", args.OrientOriginals, "re-encode full size copies of"+
+		" images with EXIF orientation to apply it, instead of linking or copying them (applies to new copies only)")
+	flag.BoolVar(&args.VerifyLinks, "verify-links", args.VerifyLinks, "check that existing full size copies match"+
+		" their sources, replace them if they don't (slow)")
+	flag.BoolVar(&args.Shard, "shard", args.Shard, "spread thumbnails and full size copies over subdirectories"+
+		" named after the first two characters of file names")
+	flag.BoolVar(&args.Schema, "schema", args.Schema, "embed schema.org ImageGallery metadata for search engines"+
+		" (requires -url)")
+	flag.IntVar(&args.GridMinWidth, "grid-min-width", gallery.DefaultGridMinWidth, "minimum width of grid columns"+
+		" in `pixels`, columns are added while they fit; with justified layout, target height of rows")
+	flag.BoolVar(&args.Spans, "spans", args.Spans, "with grid layout, make thumbnails of panoramas (twice as wide as"+
+		" high or wider) span two columns when there is room for them")
+	flag.BoolVar(&args.MarkNew, "mark-new", args.MarkNew, "mark images added during this run with a \"new\""+
+		" badge; nothing is marked when the gallery is created")
+	flag.BoolVar(&args.FeaturedApart, "featured-apart", args.FeaturedApart, "show featured images (ones with"+
+		" .featured marker files) only above the grid, not in it")
+	flag.StringVar(&args.Layout, "layout", gallery.LayoutGrid, "thumbnails `layout`: "+strings.Join(gallery.Layouts, ", "))
+	flag.IntVar(&args.IOJobs, "io-jobs", args.IOJobs, "`number` of workers reading and hashing source files"+
+		" (default GOMAXPROCS)")
+	flag.IntVar(&args.CPUJobs, "cpu-jobs", args.CPUJobs, "`number` of workers creating thumbnails and full size"+
+		" copies (default GOMAXPROCS)")
+	flag.IntVar(&args.Checkpoint, "checkpoint", args.Checkpoint, "if positive, save -cache after every `number`"+
+		" of added images, so that an interrupted run keeps metadata of images processed so far")
+	flag.IntVar(&args.Eager, "eager", args.Eager, "`number` of first thumbnails to preload and load eagerly with high"+
+		" priority, the rest are loaded lazily")
+	flag.IntVar(&args.Initial, "initial", args.Initial, "if positive, `number` of images to render initially,"+
+		" the rest are added by script on scrolling (without scripts all images are shown)")
+	flag.BoolVar(&args.NoIndex, "noindex", args.NoIndex, "ask search engines not to index gallery pages")
+	flag.BoolVar(&args.Stamp, "stamp", args.Stamp, "end html file with a comment telling program version and"+
+		" generation time")
+	flag.BoolVar(&args.Minify, "minify", args.Minify, "strip comments and insignificant whitespace from generated html")
+	flag.StringVar(&args.IDScheme, "id-scheme", args.IDScheme, "image id `scheme` used for anchors and permalink"+
+		" page names, not image file names: "+strings.Join(gallery.IDSchemes, ", ")+" (default "+gallery.IDSchemeHash+")")
+	flag.BoolVar(&args.Permalinks, "permalinks", args.Permalinks, "generate separate html page for each image"+
+		" in the "+gallery.PermalinkDir+" subdirectory next to html file")
+
+	flag.BoolVar(&args.AllowDupNames, "allow-dup-names", args.AllowDupNames, "skip images with the same content as"+
+		" already added ones from files with other names instead of failing (reported with -v)")
+	flag.StringVar(&args.OnDuplicate, "on-duplicate", gallery.DuplicateError, "`policy` for images that are"+
+		" duplicates or likely duplicates of already added ones: "+gallery.DuplicateError+" fails, "+
+		gallery.DuplicateWarn+" reports and skips them, "+gallery.DuplicateSkip+" skips them, reporting only with -v")
+	flag.BoolVar(&args.Deterministic, "deterministic", args.Deterministic, "add images to the gallery in order of"+
+		" their source paths once all are processed, so that duplicates are detected the same way on every run")
+
+	flag.BoolVar(&args.Verbose, "v", args.Verbose, "verbose output: report details like why image time was not"+
+		" taken from EXIF")
+	flag.BoolVar(&logJSON, "log-json", logJSON, "log progress, results and errors as JSON records, one per line,"+
+		" with event type in \"event\" key")
+
+	var config, extract string
+	var dump, force, check, repair, strict, timing, showVersion bool
+	flag.StringVar(&config, "config", config, "json `file` with an array of gallery definitions to generate,"+
+		" each an object with gallery.Options fields; other flags set defaults for them")
+	flag.BoolVar(&strict, "strict", strict, "with -config, stop on the first failed gallery")
+	flag.BoolVar(&timing, "timing", timing, "report time spent in generation stages (stages run in parallel"+
+		" report time summed over workers)")
 	flag.BoolVar(&dump, "dumptemplate", dump, "dump default template to stdout and exit")
+	flag.BoolVar(&showVersion, "version", showVersion, "print version and build information and exit")
+	flag.StringVar(&extract, "extract-template", extract, "write default template with a comment describing"+
+		" available data to this `file` for customization and exit")
+	flag.BoolVar(&force, "force", force, "with -extract-template, overwrite existing file")
+	flag.BoolVar(&check, "check", check, "check that images from -cache have their files in output directories,"+
+		" there are no unreferenced files there, and sources still exist; don't generate anything")
+	flag.BoolVar(&repair, "repair", repair, "recreate missing thumbnails and full size images of images from -cache"+
+		" from their sources, without walking source directories; don't generate anything else")
 	flag.Parse()
+	if args.Sharpen == 0 {
+		// -sharpen 0 disables sharpening, while in gallery.Options
+		// zero stands for the default
+		args.Sharpen = -1
+	}
 	if dump {
-		fmt.Println(defaultTemplateBody)
+		fmt.Print(gallery.DefaultTemplate)
 		return
 	}
-	if err := run(args); err != nil {
-		log.Fatal(err)
-	}
-}
-
-type runArgs struct {
-	SrcDir      string // source images
-	FullsizeDir string // destination directory for full size images
-	ThumbsDir   string // generated thumbnails directory
-	HTML        string // destination html file
-
-	Template string // optional template file to override default
-	Cache    string // optional gallery metadata cache
-	Name     string // optional gallery name
-	Phash    bool   // whether to use (slower) perceptual image hash
-}
-
-func (a *runArgs) validate() error {
-	if a.SrcDir == "" {
-		return errors.New("source directory must be set")
-	}
-	if a.FullsizeDir == "" {
-		return errors.New("destination directory must be set")
-	}
-	if a.ThumbsDir == "" {
-		return errors.New("thumbnails directory must be set")
-	}
-	if a.HTML == "" {
-		return errors.New("output html file must be set")
-	}
-	if a.FullsizeDir == a.ThumbsDir {
-		return errors.New("destination and thumbnail directories cannot be the same")
+	if showVersion {
+		printVersion()
+		return
 	}
-	if a.SrcDir == a.ThumbsDir {
-		return errors.New("source and thumbnail directories cannot be the same")
+	if extract != "" {
+		if err := extractTemplate(extract, force); err != nil {
+			fatal(err)
+		}
+		return
 	}
-	if dir, _ := filepath.Split(a.HTML); dir != "" {
-		if !strings.HasPrefix(a.ThumbsDir, dir) {
-			return errors.New("thumbnails directory cannot be above html file in FS hierarchy")
+	if check {
+		problems, err := gallery.Check(args)
+		if err != nil {
+			fatal(err)
 		}
-		if !strings.HasPrefix(a.FullsizeDir, dir) {
-			return errors.New("destination directory cannot be above html file in FS hierarchy")
+		for _, s := range problems {
+			logEvent("problem", fields{"problem": s}, s)
 		}
-	}
-	return nil
-}
-
-func run(args runArgs) error {
-	if err := args.validate(); err != nil {
-		return err
-	}
-	gallery := defaultTemplate
-	if args.Template != "" {
-		var err error
-		if gallery, err = template.ParseFiles(args.Template); err != nil {
-			return err
+		if len(problems) != 0 {
+			fatal(fmt.Errorf("%d problems found", len(problems)))
 		}
+		return
 	}
-	if err := os.MkdirAll(args.ThumbsDir, 0777); err != nil {
-		return err
-	}
-	if err := os.MkdirAll(args.FullsizeDir, 0777); err != nil {
-		return err
-	}
-	tr, err := newTransform(0, 0, 500, 500)
-	if err != nil {
-		panic(err)
-	}
-	page := &galleryCache{Name: "Gallery", UsePhash: args.Phash}
-	if args.Cache != "" {
-		switch c, err := loadCache(args.Cache); {
-		case os.IsNotExist(err):
-		case err != nil:
-			return err
-		default:
-			if c.UsePhash != page.UsePhash {
-				log.Printf("metadata cache stored with -phash=%v, using it", c.UsePhash)
-			}
-			page = c
+	args.LogEvent = logGalleryEvent
+	// the first interrupt cancels generation, so that files being written
+	// are cleaned up, the second one terminates program right away
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		signal.Stop(sigCh)
+		logEvent("interrupted", nil, "interrupted, stopping")
+		cancel()
+	}()
+	if repair {
+		n, err := gallery.Repair(ctx, args)
+		if err != nil {
+			fatal(err)
 		}
+		logEvent("repaired", fields{"count": n}, fmt.Sprintf("repaired: %d files", n))
+		return
 	}
-	if args.Name != "" {
-		page.Name = args.Name
-	}
-	workers := runtime.GOMAXPROCS(0)
-	if workers < 1 {
-		workers = 1
-	}
-	ch := make(chan string)
-	group, ctx := errgroup.WithContext(context.Background())
-	for i := 0; i < workers; i++ {
-		group.Go(func() error {
-			for p := range ch {
-				var id uint64
-				var err error
-				if page.UsePhash {
-					id, err = imagePhash(p)
-				} else {
-					id, err = fileHash(p)
-				}
-				if err != nil {
-					return err
-				}
-				fullsizeImage := filepath.Join(args.FullsizeDir, fmt.Sprintf("%x%s", id, filepath.Ext(p)))
-				thumbnailFile := filepath.Join(args.ThumbsDir, fmt.Sprintf("%x.jpg", id))
-				details := imageDetails{
-					Original:  filepath.ToSlash(fullsizeImage),
-					Thumbnail: filepath.ToSlash(thumbnailFile),
-					Source:    p,
-					Hash:      id,
-				}
-				if dir := filepath.Dir(args.HTML); dir != "" {
-					s, err := filepath.Rel(dir, fullsizeImage)
-					if err != nil {
-						return err
-					}
-					details.Original = filepath.ToSlash(s)
-					s, err = filepath.Rel(dir, thumbnailFile)
-					if err != nil {
-						return err
-					}
-					details.Thumbnail = filepath.ToSlash(s)
-				}
-				if err := createThumbnail(tr, thumbnailFile, p); err != nil {
-					return err
-				}
-				if err := linkOrCopy(fullsizeImage, p); err != nil {
-					return err
-				}
-				// TODO: maybe move isPortrait check into thumbnail generation?
-				if ok, err := isPortrait(thumbnailFile); err != nil {
-					return err
-				} else {
-					details.Portrait = ok
-				}
-				if details.Time, err = imageTime(p); err != nil {
-					return err
-				}
-				if err := page.add(details); err != nil {
-					return fmt.Errorf("adding %q: %w", p, err)
-				}
-			}
-			return nil
-		})
-	}
-	group.Go(func() error {
-		defer close(ch)
-		ticker := time.NewTicker(2 * time.Second)
-		defer ticker.Stop()
-		var n int
-		walkFunc := func(p string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if p == args.ThumbsDir || p == args.FullsizeDir {
-				return filepath.SkipDir
-			}
-			ext := filepath.Ext(p)
-			if !info.Mode().IsRegular() || !(strings.EqualFold(ext, ".jpg") || strings.EqualFold(ext, ".jpeg")) {
-				return nil
-			}
-			select {
-			case <-ctx.Done():
-				return ctx.Err()
-			case ch <- p:
-				n++
-			}
-			select {
-			case <-ticker.C:
-				log.Printf("processed %d images", n)
-			default:
-			}
-			return nil
+	if config != "" {
+		if err := runConfig(ctx, config, args, strict, timing); err != nil {
+			fatal(err)
 		}
-		return filepath.Walk(args.SrcDir, walkFunc)
-	})
-	if err := group.Wait(); err != nil {
-		return err
-	}
-	if len(page.Images) == 0 {
-		return errors.New("no images found")
-	}
-	page.sortByTime()
-	buf := new(bytes.Buffer)
-	if err := gallery.Execute(buf, page); err != nil {
-		return err
-	}
-	if err := ioutil.WriteFile(args.HTML, buf.Bytes(), 0666); err != nil {
-		return err
-	}
-	log.Printf("images added: %d, total: %d", page.n, len(page.Images))
-	if args.Cache != "" {
-		return saveCache(page, args.Cache)
-	}
-	return nil
-}
-
-type imageDetails struct {
-	Portrait  bool      `json:",omitempty"` // whether image height is larger than width
-	Original  string    // full-sized image copy
-	Thumbnail string    // thumbnail
-	Source    string    // source file name (OS and filesystem-specific)
-	Hash      uint64    `json:",string"`
-	Time      time.Time // either date from exif or mtime
-}
-
-// idToBytes returns v as byte slice laid out in big-endian order
-func idToBytes(v uint64) []byte {
-	var b []byte
-	return append(b, byte(v>>56), byte(v>>48), byte(v>>40), byte(v>>32), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
-}
-
-func (d *imageDetails) ID() string {
-	return base64.RawURLEncoding.EncodeToString(idToBytes(d.Hash))
-}
-
-// isPortrait reports whether image is in a portrait orientation (its height is
-// larger than width). It does not take EXIF rotation into account.
-func isPortrait(name string) (bool, error) {
-	f, err := os.Open(name)
-	if err != nil {
-		return false, err
+		return
 	}
-	defer f.Close()
-	cfg, err := jpeg.DecodeConfig(f)
+	res, err := gallery.Generate(ctx, args)
 	if err != nil {
-		return false, err
+		fatal(err)
 	}
-	return cfg.Height > cfg.Width, nil
+	report(res, timing)
 }
 
-func createThumbnail(tr transform, dst, src string) error {
-	thumb, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
-	if err != nil {
-		if errors.Is(err, os.ErrExist) {
-			return nil
-		}
-		return err
-	}
-	var defuse bool
-	defer func() {
-		if defuse {
-			return
-		}
-		_ = os.Remove(dst)
-	}()
-	defer thumb.Close()
-
-	f, err := os.Open(src)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	img, err := imaging.Decode(f, imaging.AutoOrientation(true))
-	if err != nil {
-		return err
-	}
-	w, h := img.Bounds().Dx(), img.Bounds().Dy()
-	if w, h, err = tr.newDimensions(w, h); err != nil {
-		return err
-	}
-	img, err = resizeImage(img, w, h)
-	if err != nil {
-		return err
+// printVersion prints program version, Go version it was built with and VCS
+// revision, if known
+func printVersion() {
+	version := "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		version = info.Main.Version
 	}
-	if err = jpeg.Encode(thumb, imaging.Sharpen(img, 0.5), &jpeg.Options{Quality: 90}); err != nil {
-		return err
-	}
-	if err = thumb.Close(); err != nil {
-		return err
+	fmt.Println("photo-gallery", version)
+	fmt.Println("built with", runtime.Version())
+	if rev := vcsRevision(); rev != "" {
+		fmt.Println("revision", rev)
 	}
-	defuse = true
-	return nil
 }
 
-// linkOrCopy creates a copy of a source file at its destination. It first
-// checks whether dst already existst and returns nil right away if it does. If
-// it does not exist, it tries to create a hard link. If that fails, it copies
-// file.
-func linkOrCopy(dst, src string) error {
-	if _, err := os.Stat(dst); err == nil {
-		return nil
-	}
-	if err := os.Link(src, dst); err == nil {
-		return nil
+// extractTemplate writes default template prefixed with
+// gallery.TemplateHeader to file name. Existing file is only overwritten if
+// force is true.
+func extractTemplate(name string, force bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
 	}
-	f, err := os.Open(src)
+	f, err := os.OpenFile(name, flags, 0666)
 	if err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("%s already exists, use -force to overwrite it", name)
+		}
 		return err
 	}
 	defer f.Close()
-	f2, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
-	if err != nil {
-		return err
-	}
-	defer f2.Close()
-	if _, err := io.Copy(f2, f); err != nil {
-		_ = os.Remove(f2.Name())
+	if _, err := io.WriteString(f, gallery.TemplateHeader+gallery.DefaultTemplate); err != nil {
 		return err
 	}
-	return f2.Close()
-}
-
-// fileHash returns content-based non-cryptographic hash of a file
-func fileHash(s string) (uint64, error) {
-	f, err := os.Open(s)
-	if err != nil {
-		return 0, err
-	}
-	defer f.Close()
-	h := fnv.New64a()
-	if _, err := io.Copy(h, f); err != nil {
-		return 0, err
-	}
-	return h.Sum64(), nil
+	return f.Close()
 }
 
-// imagePhash returns perceptual hash of an image read from the file
-func imagePhash(s string) (uint64, error) {
-	f, err := os.Open(s)
+// runConfig generates galleries defined in config file name, using base as
+// defaults for each of them. Unless strict is true or ctx is canceled, failed
+// galleries are reported and the rest are still generated. Results are
+// reported with report.
+func runConfig(ctx context.Context, name string, base gallery.Options, strict, timing bool) error {
+	b, err := ioutil.ReadFile(name)
 	if err != nil {
-		return 0, err
-	}
-	defer f.Close()
-	img, err := imaging.Decode(f, imaging.AutoOrientation(true))
-	if err != nil {
-		return 0, err
+		return err
 	}
-	return phash.Get(img, func(img image.Image, w, h int) image.Image {
-		return imaging.Resize(img, w, h, imaging.Lanczos)
-	})
-}
-
-// imageTime returns either time from EXIF metadata, or mtime of the file
-func imageTime(name string) (time.Time, error) {
-	f, err := os.Open(name)
-	if err != nil {
-		return time.Time{}, err
+	var defs []json.RawMessage
+	if err := json.Unmarshal(b, &defs); err != nil {
+		return fmt.Errorf("parsing %s: %w", name, err)
 	}
-	defer f.Close()
-	if meta, err := exif.Decode(f); err == nil {
-		if t, err := meta.DateTime(); err == nil && !t.IsZero() {
-			return t.UTC(), nil
+	var failed int
+	for i, def := range defs {
+		args := base
+		args.SrcDirs = append([]string(nil), base.SrcDirs...)
+		if err := json.Unmarshal(def, &args); err != nil {
+			return fmt.Errorf("parsing gallery #%d in %s: %w", i+1, name, err)
 		}
-		if t, err := dateTimeDigitized(meta); err == nil && !t.IsZero() {
-			return t.UTC(), nil
+		logEvent("gallery", fields{"gallery": i + 1, "html": args.HTML}, fmt.Sprintf("gallery #%d: %s", i+1, args.HTML))
+		res, err := gallery.Generate(ctx, args)
+		if err != nil {
+			if strict || ctx.Err() != nil {
+				return fmt.Errorf("gallery #%d: %w", i+1, err)
+			}
+			logEvent("error", fields{"gallery": i + 1, "error": err.Error()}, fmt.Sprintf("gallery #%d: %v", i+1, err))
+			failed++
+			continue
 		}
+		report(res, timing)
 	}
-	fi, err := f.Stat()
-	if err != nil {
-		return time.Time{}, err
+	if failed != 0 {
+		return fmt.Errorf("%d of %d galleries failed", failed, len(defs))
 	}
-	return fi.ModTime().UTC(), nil
-}
-
-// dateTimeDigitized is a copy of exif.EXIF.DateTime method, but it looks at a
-// DateTimeDigitized tag instead
-func dateTimeDigitized(x *exif.Exif) (time.Time, error) {
-	var dt time.Time
-	tag, err := x.Get(exif.DateTimeDigitized)
-	if err != nil {
-		return dt, err
-
-	}
-	if tag.Format() != tiff.StringVal {
-		return dt, errors.New("DateTimeDigitized not in string format")
-	}
-	const exifTimeLayout = "2006:01:02 15:04:05"
-	dateStr := strings.TrimRight(string(tag.Val), "\x00")
-	timeZone := time.Local
-	if tz, _ := x.TimeZone(); tz != nil {
-		timeZone = tz
-	}
-	return time.ParseInLocation(exifTimeLayout, dateStr, timeZone)
-}
-
-func resizeImage(img image.Image, width, height int) (image.Image, error) {
-	return imaging.Resize(img, width, height, imaging.CatmullRom), nil
-}
-
-type transform struct {
-	Width     int
-	Height    int
-	MaxWidth  int
-	MaxHeight int
+	return nil
 }
 
-func (tr transform) newDimensions(origWidth, origHeight int) (width, height int, err error) {
-	if origWidth == 0 || origHeight == 0 {
-		return 0, 0, errors.New("invalid source dimensions")
+// report logs generation results, with time spent in stages if timing is
+// true
+func report(res *gallery.Result, timing bool) {
+	logEvent("images", fields{"added": res.Added, "total": len(res.Images)},
+		fmt.Sprintf("images added: %d, total: %d", res.Added, len(res.Images)))
+	logEvent("written", fields{"thumbnail_bytes": res.Stats.ThumbnailBytes, "fullsize_bytes": res.Stats.FullsizeBytes,
+		"copied": res.Stats.Copied, "linked": res.Stats.Linked},
+		fmt.Sprintf("written: thumbnails %s, full size images %s (%d copied, %d hardlinked)",
+			byteSize(res.Stats.ThumbnailBytes), byteSize(res.Stats.FullsizeBytes), res.Stats.Copied, res.Stats.Linked))
+	if n := res.Stats.NotImages; n != 0 {
+		logEvent("skipped", fields{"count": n},
+			fmt.Sprintf("skipped: %d empty or non-image files with image extensions", n))
+	}
+	if n := res.Stats.Duplicates; n != 0 {
+		logEvent("duplicates", fields{"count": n}, fmt.Sprintf("skipped: %d duplicate images", n))
+	}
+	if !timing {
+		return
 	}
-	var w, h int
-	switch {
-	case tr.MaxWidth > 0 || tr.MaxHeight > 0:
-		w, h = tr.MaxWidth, tr.MaxHeight
-		// if only one max dimension specified, calculate another using
-		// original aspect ratio
-		if w == 0 {
-			w = origWidth * h / origHeight
-		}
-		if h == 0 {
-			h = origHeight * w / origWidth
-		}
-		if origWidth <= w && origHeight <= h {
-			return origWidth, origHeight, nil // image already fit
-		}
-		if tr.MaxWidth > 0 && tr.MaxHeight > 0 {
-			// maxwidth and maxheight form free aspect ratio, need
-			// to adjust w and h to match origin aspect ratio, while
-			// keeping dimensions inside max bounds
-			if float64(origWidth)/float64(origHeight) > float64(w)/float64(h) {
-				h = origHeight * w / origWidth
-			} else {
-				w = origWidth * h / origHeight
-			}
-		}
-	case tr.Width > 0 || tr.Height > 0:
-		// if both width and height specified, free aspect ratio is
-		// applied; if only one is set, original aspect ratio is kept
-		w, h = tr.Width, tr.Height
-		if w == 0 {
-			w = origWidth * h / origHeight
+	t := res.Timing
+	stages := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"walk", t.Walk},
+		{"hash", t.Hash},
+		{"thumbnails", t.Thumbnails},
+		{"full size", t.Fullsize},
+		{"render", t.Render},
+		{"total", t.Total},
+	}
+	if logJSON {
+		// one record per stage, with duration in seconds
+		for _, s := range stages {
+			logEvent("timing", fields{"stage": s.name, "duration": s.d.Seconds()}, "")
 		}
-		if h == 0 {
-			h = origHeight * w / origWidth
-		}
-	default:
-		return 0, 0, fmt.Errorf("invalid transform %v", tr)
-	}
-	// if w*h > pixelLimit || w >= 1<<16 || h >= 1<<16 {
-	// 	return 0, 0, errors.New("destination size exceeds limit")
-	// }
-	return w, h, nil
-}
-
-func newTransform(width, height, maxWidth, maxHeight int) (transform, error) {
-	tr := transform{
-		Width:     width,
-		Height:    height,
-		MaxWidth:  maxWidth,
-		MaxHeight: maxHeight,
+		return
 	}
-	if tr.Width == 0 && tr.Height == 0 && tr.MaxWidth == 0 && tr.MaxHeight == 0 {
-		return transform{}, errors.New("no valid dimensions specified")
+	buf := new(bytes.Buffer)
+	tw := tabwriter.NewWriter(buf, 0, 0, 2, ' ', 0)
+	for _, s := range stages {
+		fmt.Fprintf(tw, "%s\t%s\n", s.name, s.d.Round(time.Millisecond))
 	}
-	// if tr.Width*tr.Height > pixelLimit || tr.MaxWidth > pixelLimit || tr.MaxHeight > pixelLimit {
-	// 	return transform{}, errors.New("destination size exceeds limit")
-	// }
-	return tr, nil
-}
-
-type galleryCache struct {
-	Name     string
-	UsePhash bool
-
-	// onceSortPhash guards initial sort of Images by increasing Hash when run
-	// with UserPhash=true, so add method can rely on binary search
-	onceSortPhash sync.Once
-
-	mu     sync.Mutex
-	Images []imageDetails
-
-	// dups is used to track duplicates when UsePhash=false, and
-	// imageDetails.Hash holds file-based hash
-	dups map[uint64]string // key is imageDetails.Hash, value is imageDetails.Source
-	n    int               // number of images added to the gallery during program run
+	tw.Flush()
+	log.Printf("timing:\n%s", buf)
 }
 
-// sortByTime sorts gallery dy time in descending order (newest images first)
-func (c *galleryCache) sortByTime() {
-	sort.Slice(c.Images, func(i, j int) bool {
-		return c.Images[i].Time.After(c.Images[j].Time)
-	})
-}
-
-// minDiff is a phash distance similarity threshold: phash distance above this
-// threshold are treated as different images, images with phash distance equal
-// or below this threshold are reported as likely duplicates
-const minDiff = 5
-
-func (c *galleryCache) addWithPhash(info imageDetails) error {
-	c.onceSortPhash.Do(func() {
-		sort.SliceStable(c.Images, func(i, j int) bool {
-			return c.Images[i].Hash < c.Images[j].Hash
-		})
-	})
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// stringList is a flag.Value collecting values of a repeated flag
+type stringList []string
 
-	i := sort.Search(len(c.Images), func(i int) bool { return c.Images[i].Hash >= info.Hash })
+func (l *stringList) String() string { return strings.Join(*l, ", ") }
 
-	if i == len(c.Images) {
-		if i != 0 {
-			info2 := c.Images[i-1]
-			if diff := phash.Distance(info.Hash, info2.Hash); diff <= minDiff {
-				return fmt.Errorf("possible duplicate (phash similarity distance=%d)"+
-					" of %q (source filename %q)", diff, info2.Original, info2.Source)
-			}
-		}
-		c.Images = append(c.Images, info)
-		c.n++
-		return nil
-	}
-	if info2 := c.Images[i]; info2.Hash == info.Hash {
-		if info2.Source == info.Source && info2.Time.Equal(info.Time) { // attempt to re-add the same image
-			return nil
-		}
-		return fmt.Errorf("duplicate (same phash) of %q (source filename %q)", info2.Original, info2.Source)
-	}
-
-	// the index is [i] here, and not [i+1], because this check is *before*
-	// info is inserted into c.Images slice, so an element that would be to its
-	// right is still at position [i]
-	info2 := c.Images[i]
-	if diff := phash.Distance(info.Hash, info2.Hash); diff <= minDiff {
-		return fmt.Errorf("possible duplicate (phash similarity distance=%d)"+
-			" of %q (source filename %q)", diff, info2.Original, info2.Source)
-	}
-	if i > 0 {
-		info2 = c.Images[i-1]
-		if diff := phash.Distance(info.Hash, info2.Hash); diff <= minDiff {
-			return fmt.Errorf("possible duplicate (phash similarity distance=%d)"+
-				" of %q (source filename %q)", diff, info2.Original, info2.Source)
-		}
-	}
-
-	head := c.Images[:i+1]
-	tail := make([]imageDetails, len(c.Images[i:]))
-	copy(tail, c.Images[i:])
-	head[i] = info
-	c.Images = append(head, tail...)
-	c.n++
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
 	return nil
 }
 
-func (c *galleryCache) add(info imageDetails) error {
-	if c.UsePhash {
-		return c.addWithPhash(info)
-	}
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if c.dups == nil {
-		c.dups = make(map[uint64]string, len(c.Images))
-		for _, info := range c.Images {
-			c.dups[info.Hash] = info.Source
-		}
-	}
-	if s, ok := c.dups[info.Hash]; ok {
-		if s == info.Source { // same image, ok to skip
-			return nil
-		}
-		return fmt.Errorf("gallery already has image with id %q: %q (original file name)", info.ID(), s)
+// octalMode is a flag.Value parsing file permissions in octal notation
+type octalMode os.FileMode
+
+func (m *octalMode) String() string {
+	if *m == 0 {
+		return ""
 	}
-	c.Images = append(c.Images, info)
-	c.dups[info.Hash] = info.Source
-	c.n++
-	return nil
+	return fmt.Sprintf("%#o", uint32(*m))
 }
 
-func loadCache(name string) (*galleryCache, error) {
-	f, err := os.Open(name)
+func (m *octalMode) Set(s string) error {
+	v, err := strconv.ParseUint(s, 8, 32)
 	if err != nil {
-		return nil, err
+		return errors.New("permissions must be an octal number like 0755")
 	}
-	defer f.Close()
-	cache := &galleryCache{}
-	if err := json.NewDecoder(f).Decode(cache); err != nil {
-		return nil, err
-	}
-	return cache, nil
+	*m = octalMode(v)
+	return nil
 }
 
-func saveCache(cache *galleryCache, name string) error {
-	tf, err := ioutil.TempFile(filepath.Dir(name), "photo-gallery-cache-*.tmp")
-	if err != nil {
-		return err
-	}
-	defer tf.Close()
-	var defuse bool
-	defer func() {
-		if !defuse {
-			_ = os.Remove(tf.Name())
-		}
-	}()
-	enc := json.NewEncoder(tf)
-	enc.SetIndent("", "\t")
-	if err := enc.Encode(cache); err != nil {
-		return err
+// byteSize returns human-readable size
+func byteSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
 	}
-	if err := tf.Close(); err != nil {
-		return err
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
 	}
-	defuse = true
-	return os.Rename(tf.Name(), name)
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
 }
-
-var defaultTemplate = template.Must(template.New("gallery").Parse(defaultTemplateBody))
-
-const defaultTemplateBody = `<!DOCTYPE html><head><meta charset="utf-8">
-<title>{{.Name}}</title>
-<meta name="viewport" content="width=device-width, initial-scale=1">
-{{$max := 5}}{{$slen := len .Images}}{{if lt $slen $max}}{{$max = $slen}}{{end}}{{range slice .Images 0 $max}}
-<link rel="preload" as="image" type="image/jpeg" href="{{.Thumbnail}}">{{end}}
-<style>
-	* {box-sizing: border-box; border: none; font-family: ui-sans-serif, sans-serif;}
-	html {background-color: whitesmoke; padding:0;margin:0;}
-	body {padding:0;margin:0;}
-	header, footer {line-height: 1.7; padding: 5px; background-color: black; color: white;}
-	h1 {font-style: bold; font-size:x-large; margin:0;padding:0;}
-	footer {text-align: center;}
-	.gallery {
-        display: grid;
-        grid-template-columns: repeat(auto-fit, minmax(300px, 1fr));
-        grid-gap: 5px;
-        grid-auto-flow: row dense;
-
-        padding: 5px;
-        margin: auto;
-    }
-    .gallery .portrait {
-        grid-row-end: span 2;
-    }
-    .gallery img {
-        display: block;
-        object-fit: cover;
-        width: 100%;
-		height: 100%;
-    }
-    figure {
-        padding: 0;
-        margin: 0;
-    }
-    .lightbox {
-        display: none;
-    }
-    .lightbox:target {
-        z-index: 999;
-        outline: none;
-        display: block;
-        position: fixed;
-        top: 0;
-        left: 0;
-        width: 100%;
-        height: 100vh;
-        background-color: rgba(0, 0, 0, 0.9);
-    }
-    .lightbox:target img {
-        object-fit: scale-down;
-        width: 100%;
-        height: 100%;
-    }
-</style>
-</head>
-<body>
-<header><h1>{{.Name}}</h1></header>
-<main class="gallery">
-{{range $i, $img := .Images}}
-	<figure{{if $img.Portrait}} class="portrait"{{end}}><a href="#{{$img.ID}}">
-	<img {{if gt $i 10}}loading="lazy" {{end}}src="{{$img.Thumbnail}}">
-	</a>
-	</figure>
-{{end}}
-</main>
-<div class="fullsize-images">
-{{range .Images}}
-	<figure class="lightbox" id="{{.ID}}">
-		<a href="#back">
-		<img loading="lazy" src="{{.Original}}">
-		</a>
-	</figure>
-{{end}}
-</div>
-<footer>&copy; all rights reserved</footer>
-</body>
-`
@@ -0,0 +1,31 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import "runtime/debug"
+
+// vcsRevision returns VCS revision the program was built from, with
+// "(modified)" appended if working tree had uncommitted changes, or an empty
+// string if it is not known
+func vcsRevision() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	var rev, modified string
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			rev = s.Value
+		case "vcs.modified":
+			if s.Value == "true" {
+				modified = " (modified)"
+			}
+		}
+	}
+	if rev == "" {
+		return ""
+	}
+	return rev + modified
+}
@@ -0,0 +1,8 @@
+//go:build !go1.18
+// +build !go1.18
+
+package main
+
+// vcsRevision returns an empty string, as Go versions before 1.18 do not
+// record VCS revision in binaries
+func vcsRevision() string { return "" }